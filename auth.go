@@ -2,18 +2,26 @@
 package sauth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/efureev/sauth/avatar"
+	"github.com/efureev/sauth/limit"
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	"github.com/efureev/sauth/middleware"
 	"github.com/efureev/sauth/provider"
 	"github.com/efureev/sauth/redirect"
 	"github.com/efureev/sauth/token"
 	"github.com/go-pkgz/rest"
+	"github.com/go-pkgz/rest/realip"
+	"github.com/golang-jwt/jwt"
 )
 
 // Client is a type of auth client
@@ -27,6 +35,7 @@ type ProviderConfig struct {
 	Client
 	Enabled bool
 	Name    string
+	PKCE    bool // use PKCE for oauth2 providers
 }
 
 // Service provides higher level wrapper allowing to construct everything and get back token middleware
@@ -39,15 +48,26 @@ type Service struct {
 	avatarProxy    *avatar.Proxy
 	issuer         string
 	useGravatar    bool
+
+	mfaTokenAttempts *mfa.Attempts // failed codes per token, pending token burned after the max
+	mfaUserAttempts  *mfa.Attempts // failed codes per user, across tokens
 }
 
+const (
+	mfaMaxTokenAttempts = 5
+	mfaMaxUserAttempts  = 10
+)
+
 // Opts is a full set of all parameters to initialize Service
 type Opts struct {
-	SecretReader   token.Secret        // reader returns secret for given site id (aud), required
+	SecretReader   token.Secret        // reader returns secret for given site id (aud), required if KeySet not defined
+	KeySet         token.KeySet        // asymmetric keys (RS256, ES256, EdDSA) to sign tokens, optional
+	Encrypter      token.Encrypter     // encrypts signed tokens (nested JWE) to hide claims, optional
 	ClaimsUpd      token.ClaimsUpdater // updater for jwt to add/modify values stored in the token
 	SecureCookies  bool                // makes jwt cookie secure
-	TokenDuration  time.Duration       // token's TTL, refreshed automatically
+	TokenDuration  time.Duration       // token's TTL, refreshed with refresh token or automatically with SilentRefresh
 	CookieDuration time.Duration       // cookie's TTL. This cookie stores JWT token
+	Leeway         time.Duration       // tolerated clock skew for token's exp, nbf and iat, i.e. between pods
 
 	DisableXSRF bool // disable XSRF protection, useful for testing/debugging
 	DisableIAT  bool // disable IssuedAt claim
@@ -62,6 +82,10 @@ type Opts struct {
 	SendJWTHeader   bool          // if enabled send JWT as a header instead of cookie
 	SameSiteCookie  http.SameSite // limit cross-origin requests with SameSite cookie attribute
 
+	// ordered places to look for the token, default query, X-JWT header, Authorization bearer and cookie.
+	// The list without token.SourceQuery disables query-string tokens
+	TokenSources []token.TokenSource
+
 	Issuer string // optional value for iss claim, usually the application name, default "go-pkgz/auth"
 
 	URL       string          // root url for the rest service, i.e. http://blah.example.com, required
@@ -78,9 +102,30 @@ type Opts struct {
 	AudSecrets       bool                     // allow multiple secrets (secret per aud)
 	Logger           logger.L                 // logger interface, default is no logging at all
 	RefreshCache     middleware.RefreshCache  // optional cache to keep refreshed tokens
+	RevocationStore  token.RevocationStore    // optional store of revoked tokens, populated on logout
+	RefreshStore     token.RefreshStore       // optional store of refresh tokens, enables `/refresh`
+	RefreshDuration  time.Duration            // refresh token's TTL, default CookieDuration
+	SilentRefresh    bool                     // re-issue expired token in Auth middleware while cookie alive
+	SessionStore     token.SessionStore       // optional store of user's sessions, enables `/sessions`
+	Roles            *token.RoleTable         // optional role hierarchy and permissions for RBAC and RequirePermission
+
+	DecisionLog middleware.DecisionLogger // optional log of authorization policy decisions, see middleware.Policies
+
+	SecondFactor mfa.SecondFactor // optional second factor, enables `/mfa/enroll` and `/mfa/verify`
+
+	UpstreamTokenStore provider.UpstreamTokenStore // optional store of oauth2 tokens issued by providers
+	IdentityStore      provider.IdentityStore      // optional store of linked identities, enables `/{provider}/link`
+
+	ConfirmationStore provider.ConfirmationStore // optional store making confirmations of verify providers one-time
+
+	Limits limit.Limits // optional limits of login attempts per ip, user and address, lockout after failed passwords
 
 	RefreshTokenOnStatus bool // refresh jwt-token on `/status` request from browser (with sessions)
 
+	IntrospectionChecker middleware.BasicAuthFunc // checks client credentials of `/introspect`, enables the endpoint
+
+	JWKSMaxAge time.Duration // cache duration of public keys served by `/jwks`, default 1h
+
 	RedirectBuilder redirect.RedirectBuilderFn
 }
 
@@ -95,6 +140,10 @@ func NewService(opts Opts) (res *Service) {
 			AdminPasswd:      opts.AdminPasswd,
 			BasicAuthChecker: opts.BasicAuthChecker,
 			RefreshCache:     opts.RefreshCache,
+			SilentRefresh:    opts.SilentRefresh,
+			SessionStore:     opts.SessionStore,
+			Roles:            opts.Roles,
+			DecisionLog:      opts.DecisionLog,
 		},
 		issuer:      opts.Issuer,
 		useGravatar: opts.UseGravatar,
@@ -110,10 +159,13 @@ func NewService(opts Opts) (res *Service) {
 
 	jwtService := token.NewService(token.Opts{
 		SecretReader:    opts.SecretReader,
+		KeySet:          opts.KeySet,
+		Encrypter:       opts.Encrypter,
 		ClaimsUpd:       opts.ClaimsUpd,
 		SecureCookies:   opts.SecureCookies,
 		TokenDuration:   opts.TokenDuration,
 		CookieDuration:  opts.CookieDuration,
+		Leeway:          opts.Leeway,
 		DisableXSRF:     opts.DisableXSRF,
 		DisableIAT:      opts.DisableIAT,
 		JWTCookieName:   opts.JWTCookieName,
@@ -123,13 +175,19 @@ func NewService(opts Opts) (res *Service) {
 		XSRFHeaderKey:   opts.XSRFHeaderKey,
 		SendJWTHeader:   opts.SendJWTHeader,
 		JWTQuery:        opts.JWTQuery,
+		TokenSources:    opts.TokenSources,
 		Issuer:          res.issuer,
 		AudienceReader:  opts.AudienceReader,
 		AudSecrets:      opts.AudSecrets,
 		SameSite:        opts.SameSiteCookie,
+		RevocationStore: opts.RevocationStore,
+		RefreshStore:    opts.RefreshStore,
+		RefreshDuration: opts.RefreshDuration,
+		SessionStore:    opts.SessionStore,
+		Logger:          res.logger,
 	})
 
-	if opts.SecretReader == nil {
+	if opts.SecretReader == nil && opts.KeySet == nil {
 		jwtService.SecretReader = token.SecretFunc(func(string) (string, error) {
 			return "", fmt.Errorf("secrets reader not available")
 		})
@@ -157,6 +215,9 @@ func NewService(opts Opts) (res *Service) {
 		res.opts.RedirectBuilder = redirect.DefaultRedirect()
 	}
 
+	res.mfaTokenAttempts = mfa.NewAttempts(mfaMaxTokenAttempts, 10*time.Minute) // longer than pending token lives
+	res.mfaUserAttempts = mfa.NewAttempts(mfaMaxUserAttempts, time.Hour)
+
 	return res
 }
 
@@ -187,14 +248,57 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 				rest.RenderJSON(w, rest.JSON{"error": "provides not defined"})
 				return
 			}
+			s.revokeToken(r)
 			s.providers[0].Handler(w, r)
 			return
 		}
 
+		// exchange refresh token to the new pair of tokens
+		if elems[len(elems)-1] == "refresh" {
+			s.refreshHandler(w, r)
+			return
+		}
+
+		// list and revoke user's sessions, /sessions and /sessions/{id}
+		if elems[len(elems)-1] == "sessions" || elems[len(elems)-2] == "sessions" {
+			s.sessionsHandler(w, r)
+			return
+		}
+
+		// public keys to verify tokens, /jwks or /.well-known/jwks.json
+		if elems[len(elems)-1] == "jwks" || elems[len(elems)-1] == "jwks.json" {
+			s.jwksHandler(w, r)
+			return
+		}
+
+		// token introspection for other services, RFC 7662
+		if elems[len(elems)-1] == "introspect" {
+			s.introspectHandler(w, r)
+			return
+		}
+
+		// link provider to logged-in user and unlink it, /{provider}/link and /{provider}/unlink
+		if elems[len(elems)-1] == "link" || elems[len(elems)-1] == "unlink" {
+			s.linkHandler(w, r, elems[len(elems)-2], elems[len(elems)-1] == "unlink")
+			return
+		}
+
+		// identities linked to logged-in user
+		if elems[len(elems)-1] == "identities" {
+			s.identitiesHandler(w, r)
+			return
+		}
+
+		// second factor enrollment and verification, /mfa/enroll and /mfa/verify
+		if elems[len(elems)-2] == "mfa" {
+			s.mfaHandler(w, r, elems[len(elems)-1])
+			return
+		}
+
 		// show user info
 		if elems[len(elems)-1] == "user" {
 			claims, _, err := s.jwtService.Get(r)
-			if err != nil || claims.User == nil {
+			if err != nil || claims.User == nil || claims.Handshake != nil || claims.MFARequired {
 				w.WriteHeader(http.StatusUnauthorized)
 				eMsg := `unauthorized`
 				if err != nil {
@@ -210,11 +314,26 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 		// status of logged-in user
 		if elems[len(elems)-1] == "status" {
 			claims, _, err := s.jwtService.Get(r)
-			if err != nil && err != token.NeedToRegenerateTokenError || claims.User == nil {
-				rest.RenderJSON(w, rest.JSON{"status": "not logged in", "logged": false, "message": err.Error()})
+			if err != nil && err != token.NeedToRegenerateTokenError || claims.User == nil || claims.Handshake != nil {
+				eMsg := `not logged in`
+				if err != nil {
+					eMsg = err.Error()
+				}
+				rest.RenderJSON(w, rest.JSON{"status": "not logged in", "logged": false, "message": eMsg})
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			if claims.MFARequired {
+				rest.RenderJSON(w, rest.JSON{"status": "mfa required", "logged": false, "mfa_required": true})
+				return
+			}
+			if s.opts.SessionStore != nil {
+				if e := token.CheckSession(s.opts.SessionStore, claims.Id, claims.IssuedAt); e != nil {
+					s.jwtService.Reset(w)
+					rest.RenderJSON(w, rest.JSON{"status": "not logged in", "logged": false, "message": e.Error()})
+					return
+				}
+			}
 			if s.opts.RefreshTokenOnStatus && err == token.NeedToRegenerateTokenError {
 				claims, err = s.refreshExpiredToken(w, claims)
 				if err != nil {
@@ -231,6 +350,9 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 		}
 
 		// regular auth handlers
+		if !s.checkLimits(w, r, "") {
+			return
+		}
 		provName := elems[len(elems)-2]
 		p, err := s.Provider(provName)
 		if err != nil {
@@ -241,7 +363,381 @@ func (s *Service) Handlers() (authHandler, avatarHandler http.Handler) {
 		p.Handler(w, r)
 	}
 
-	return http.HandlerFunc(ah), http.HandlerFunc(s.avatarProxy.Handler)
+	return s.jwtService.DropStaleChunks(http.HandlerFunc(ah)), http.HandlerFunc(s.avatarProxy.Handler)
+}
+
+// refreshHandler issues new access and refresh tokens for the presented refresh token
+// POST /refresh with refresh token in cookie, header or "refresh_token" form value
+func (s *Service) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.opts.RefreshStore == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("refresh store not defined"), "refresh not available")
+		return
+	}
+	claims, err := s.jwtService.Refresh(w, r)
+	if err != nil {
+		if err == token.RefreshTokenReusedError {
+			s.logger.Logf("[WARN] refresh token reused, token family revoked")
+		}
+		s.jwtService.Reset(w)
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, err, "can't refresh token")
+		return
+	}
+	rest.RenderJSON(w, claims.User)
+}
+
+// sessionsHandler lists and revokes sessions of the current user
+// GET /sessions - list of active sessions
+// DELETE /sessions - revoke all sessions except the current one
+// DELETE /sessions/{id} - revoke session by id
+func (s *Service) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.SessionStore == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("session store not defined"), "sessions not available")
+		return
+	}
+
+	claims, _, err := s.jwtService.Get(r)
+	if err != nil && err != token.NeedToRegenerateTokenError || claims.User == nil || claims.Handshake != nil || claims.MFARequired {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, err, "unauthorized")
+		return
+	}
+
+	sessions, err := s.opts.SessionStore.List(claims.User.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't list sessions")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rest.RenderJSON(w, rest.JSON{"current": claims.Id, "sessions": sessions})
+	case http.MethodDelete:
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		var revoked []string
+		for _, sess := range sessions {
+			if (id == "sessions" && sess.ID != claims.Id) || sess.ID == id {
+				if err = s.jwtService.Revoke(token.Claims{StandardClaims: jwt.StandardClaims{Id: sess.ID}}); err != nil {
+					rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't revoke session")
+					return
+				}
+				revoked = append(revoked, sess.ID)
+			}
+		}
+		if id == claims.Id {
+			s.jwtService.Reset(w) // current session revoked, same as logout
+		}
+		if id != "sessions" && len(revoked) == 0 {
+			rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("session %s not found", id), "session not found")
+			return
+		}
+		rest.RenderJSON(w, rest.JSON{"revoked": revoked})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// linkHandler starts linking of the provider to the current user or unlinks it
+// GET /{provider}/link?from=url - sets link token and redirects to provider's login, passing all query params
+// POST|DELETE /{provider}/unlink - removes identities of the provider from the current user
+func (s *Service) linkHandler(w http.ResponseWriter, r *http.Request, provName string, unlink bool) {
+	if s.opts.IdentityStore == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("identity store not defined"), "linking not available")
+		return
+	}
+	if _, err := s.Provider(provName); err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusBadRequest, err, fmt.Sprintf("provider %s not supported", provName))
+		return
+	}
+
+	claims, _, err := s.jwtService.Get(r)
+	if err != nil && err != token.NeedToRegenerateTokenError || claims.User == nil || claims.Handshake != nil || claims.MFARequired {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, err, "unauthorized")
+		return
+	}
+
+	if unlink {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err = s.opts.IdentityStore.Unlink(claims.User.ID, provName); err != nil {
+			rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't unlink identity")
+			return
+		}
+		rest.RenderJSON(w, rest.JSON{"unlinked": provName})
+		return
+	}
+
+	linkClaims := token.Claims{
+		User:      claims.User,
+		Handshake: &token.Handshake{ID: "link"},
+		StandardClaims: jwt.StandardClaims{
+			Audience:  claims.Audience,
+			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+		},
+	}
+	tkn, err := s.jwtService.Token(linkClaims)
+	if err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't make link token")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: provider.LinkCookieName, Value: tkn, HttpOnly: true, Path: "/",
+		MaxAge: int((30 * time.Minute).Seconds()), Secure: s.opts.SecureCookies, SameSite: http.SameSiteLaxMode})
+
+	loginURL := strings.TrimSuffix(r.URL.Path, "/link") + "/login"
+	if r.URL.RawQuery != "" {
+		loginURL += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+}
+
+// identitiesHandler lists identities linked to the current user, GET /identities
+func (s *Service) identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.IdentityStore == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("identity store not defined"), "linking not available")
+		return
+	}
+	claims, _, err := s.jwtService.Get(r)
+	if err != nil && err != token.NeedToRegenerateTokenError || claims.User == nil || claims.Handshake != nil || claims.MFARequired {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, err, "unauthorized")
+		return
+	}
+	ids, err := s.opts.IdentityStore.List(claims.User.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't list identities")
+		return
+	}
+	rest.RenderJSON(w, ids)
+}
+
+// mfaHandler enrolls and verifies second factor.
+// POST /mfa/enroll starts enrollment for logged-in user and returns secret, otpauth:// uri and recovery codes.
+// POST /mfa/verify with "code" form value exchanges pending (mfa_required) token to the full one,
+// or confirms enrollment for logged-in user.
+func (s *Service) mfaHandler(w http.ResponseWriter, r *http.Request, action string) {
+	if s.opts.SecondFactor == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("second factor not defined"), "mfa not available")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _, err := s.jwtService.Get(r)
+	if err != nil || claims.User == nil || claims.Handshake != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, err, "unauthorized")
+		return
+	}
+
+	switch action {
+	case "enroll":
+		if claims.MFARequired {
+			rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, nil, "second factor not verified")
+			return
+		}
+		account := claims.User.Email
+		if account == "" {
+			account = claims.User.Name
+		}
+		enrollment, err := s.opts.SecondFactor.Enroll(claims.User.ID, account)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, mfa.EnrolledError) {
+				code = http.StatusConflict
+			}
+			rest.SendErrorJSON(w, r, s.logger, code, err, "can't enroll second factor")
+			return
+		}
+		rest.RenderJSON(w, enrollment)
+	case "verify":
+		if !s.checkLimits(w, r, "mfa:"+claims.User.ID) {
+			return
+		}
+		if s.mfaTokenAttempts.Exceeded(claims.Id) || s.mfaUserAttempts.Exceeded(claims.User.ID) {
+			if claims.MFARequired {
+				s.jwtService.Reset(w)
+			}
+			rest.SendErrorJSON(w, r, s.logger, http.StatusTooManyRequests, nil, "too many failed attempts")
+			return
+		}
+		ok, err := s.opts.SecondFactor.Verify(claims.User.ID, r.FormValue("code"))
+		if err != nil {
+			rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't verify code")
+			return
+		}
+		if !ok {
+			tokenBurned := s.mfaTokenAttempts.Fail(claims.Id)
+			s.mfaUserAttempts.Fail(claims.User.ID)
+			if tokenBurned && claims.MFARequired {
+				s.jwtService.Reset(w) // pending token can't be used anymore, login again
+			}
+			rest.SendErrorJSON(w, r, s.logger, http.StatusForbidden, nil, "invalid code")
+			return
+		}
+		s.mfaTokenAttempts.Reset(claims.Id)
+		s.mfaUserAttempts.Reset(claims.User.ID)
+		if !claims.MFARequired {
+			rest.RenderJSON(w, rest.JSON{"enrolled": true})
+			return
+		}
+		claims.MFARequired = false
+		claims.ExpiresAt = 0 // set by TokenDuration
+		claims.SetAuth(append(claims.AMR, token.AMROTP)...)
+		if claims, err = s.jwtService.Set(w, claims); err != nil {
+			rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "failed to set token")
+			return
+		}
+		rest.RenderJSON(w, claims.User)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// checkLimits takes tokens of client ip and user (if not empty) from opts.Limits.
+// Request exceeded any of them rejected with 429 and Retry-After, false returned in this case.
+func (s *Service) checkLimits(w http.ResponseWriter, r *http.Request, user string) bool {
+	ip, _ := realip.Get(r)
+	wait, err := s.opts.Limits.Check(ip, user, "")
+	if err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "failed to check limits")
+		return false
+	}
+	if wait > 0 {
+		limit.SetRetryAfter(w, wait)
+		rest.SendErrorJSON(w, r, s.logger, http.StatusTooManyRequests, fmt.Errorf("limit exceeded"), "too many requests")
+		return false
+	}
+	return true
+}
+
+// providerLimits returns limits for direct and verify providers, ip limit applied by auth handler already
+func (s *Service) providerLimits() limit.Limits {
+	res := s.opts.Limits
+	res.IP = nil
+	return res
+}
+
+// introspectHandler tells the client if the token is active, RFC 7662
+// POST /introspect with client credentials in basic auth and "token" form value
+func (s *Service) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.IntrospectionChecker == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("introspection checker not defined"),
+			"introspection not available")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, secret, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, fmt.Errorf("no client credentials"), "unauthorized")
+		return
+	}
+	if valid, _, err := s.opts.IntrospectionChecker(client, secret); err != nil || !valid {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		rest.SendErrorJSON(w, r, s.logger, http.StatusUnauthorized, fmt.Errorf("client %s rejected: %v", client, err),
+			"unauthorized")
+		return
+	}
+
+	tkn := r.PostFormValue("token")
+	if tkn == "" {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusBadRequest, fmt.Errorf("no token"), "invalid_request")
+		return
+	}
+
+	claims, err := s.introspect(tkn)
+	if err != nil {
+		s.logger.Logf("[DEBUG] token introspected by %s is not active, %v", client, err)
+		rest.RenderJSON(w, rest.JSON{"active": false})
+		return
+	}
+
+	res := rest.JSON{}
+	if data, e := json.Marshal(claims.User); e == nil {
+		_ = json.Unmarshal(data, &res)
+	}
+	res["active"] = true
+	res["sub"] = claims.User.ID
+	res["username"] = claims.User.Name
+	res["aud"] = claims.Audience
+	res["exp"] = claims.ExpiresAt
+	res["iss"] = claims.Issuer
+	res["jti"] = claims.Id
+	if claims.IssuedAt != 0 {
+		res["iat"] = claims.IssuedAt
+	}
+	if claims.Scope != "" {
+		res["scope"] = claims.Scope
+	}
+	if claims.AuthTime != 0 {
+		res["auth_time"] = claims.AuthTime
+		res["amr"] = claims.AMR
+	}
+	if len(claims.Extra) > 0 {
+		res["extra"] = claims.Extra
+	}
+	rest.RenderJSON(w, res)
+}
+
+// introspect checks the token the same way Auth middleware does
+func (s *Service) introspect(tkn string) (token.Claims, error) {
+	claims, err := s.jwtService.Check(tkn)
+	if err != nil {
+		return token.Claims{}, err
+	}
+	if claims.User == nil || claims.Handshake != nil || claims.MFARequired {
+		return token.Claims{}, fmt.Errorf("not a user token")
+	}
+	if s.opts.Validator != nil && !s.opts.Validator.Validate(tkn, claims) {
+		return token.Claims{}, fmt.Errorf("user %s/%s blocked", claims.User.Name, claims.User.ID)
+	}
+	if s.opts.SessionStore != nil {
+		if err = token.CheckSession(s.opts.SessionStore, claims.Id, claims.IssuedAt); err != nil {
+			return token.Claims{}, err
+		}
+	}
+	return claims, nil
+}
+
+// revokeToken revokes token from the request and its refresh tokens, so the copy of logged out token can't be used
+func (s *Service) revokeToken(r *http.Request) {
+	if s.opts.RevocationStore == nil && s.opts.RefreshStore == nil {
+		return
+	}
+	claims, _, err := s.jwtService.Get(r)
+	if err != nil && err != token.NeedToRegenerateTokenError {
+		return
+	}
+	if err = s.jwtService.Revoke(claims); err != nil {
+		s.logger.Logf("[WARN] can't revoke token on logout, %v", err)
+	}
+}
+
+// jwksHandler renders public part of signing keys as JWK Set
+func (s *Service) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.KeySet == nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusNotFound, fmt.Errorf("key set not defined"), "jwks not available")
+		return
+	}
+	jwks, err := s.jwtService.JWKS()
+	if err != nil {
+		rest.SendErrorJSON(w, r, s.logger, http.StatusInternalServerError, err, "can't get jwks")
+		return
+	}
+	maxAge := s.opts.JWKSMaxAge
+	if maxAge == 0 {
+		maxAge = time.Hour
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	rest.RenderJSON(w, jwks)
 }
 
 func (s *Service) refreshExpiredToken(w http.ResponseWriter, claims token.Claims) (token.Claims, error) {
@@ -277,7 +773,12 @@ func (s *Service) DefaultParams(pConf ProviderConfig) provider.Params {
 		AvatarSaver:     s.avatarProxy,
 		Cid:             pConf.Cid,
 		Csecret:         pConf.Csecret,
+		PKCE:            pConf.PKCE,
 		L:               s.logger,
+
+		UpstreamTokenStore: s.opts.UpstreamTokenStore,
+		IdentityStore:      s.opts.IdentityStore,
+		SecondFactor:       s.opts.SecondFactor,
 	}
 }
 
@@ -323,6 +824,9 @@ func (s *Service) AddDevProvider(port int) {
 		AvatarSaver: s.avatarProxy,
 		L:           s.logger,
 		Port:        port,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
 	}
 	s.providers = append(s.providers, provider.NewService(provider.NewDev(p)))
 }
@@ -335,6 +839,9 @@ func (s *Service) AddAppleProvider(appleConfig provider.AppleConfig, privKeyLoad
 		Issuer:      s.issuer,
 		AvatarSaver: s.avatarProxy,
 		L:           s.logger,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
 	}
 
 	// Error checking at create need for catch one when apple private key init
@@ -357,12 +864,44 @@ func (s *Service) AddCustomProvider(name string, client Client, copts provider.C
 		Cid:         client.Cid,
 		Csecret:     client.Csecret,
 		L:           s.logger,
+
+		UpstreamTokenStore: s.opts.UpstreamTokenStore,
+		IdentityStore:      s.opts.IdentityStore,
+		SecondFactor:       s.opts.SecondFactor,
 	}
 
 	s.providers = append(s.providers, provider.NewService(provider.NewCustom(name, p, copts)))
 	s.authMiddleware.Providers = s.providers
 }
 
+// AddOIDCProvider adds generic OpenID Connect provider (Keycloak, Okta, Auth0, Dex, Azure AD and so on)
+// with endpoints and keys discovered from issuerURL
+func (s *Service) AddOIDCProvider(client Client, issuerURL string, opts provider.OIDCOpt) error {
+	p := provider.Params{
+		URL:             s.opts.URL,
+		RedirectBuilder: s.opts.RedirectBuilder,
+		JwtService:      s.jwtService,
+		Issuer:          s.issuer,
+		AvatarSaver:     s.avatarProxy,
+		Cid:             client.Cid,
+		Csecret:         client.Csecret,
+		L:               s.logger,
+
+		UpstreamTokenStore: s.opts.UpstreamTokenStore,
+		IdentityStore:      s.opts.IdentityStore,
+		SecondFactor:       s.opts.SecondFactor,
+	}
+
+	oidcProvider, err := provider.NewOIDC(p, issuerURL, opts)
+	if err != nil {
+		return fmt.Errorf("an OIDC provider creating failed: %w", err)
+	}
+
+	s.providers = append(s.providers, provider.NewService(oidcProvider))
+	s.authMiddleware.Providers = s.providers
+	return nil
+}
+
 // AddDirectProvider adds provider with direct check against data store
 // it doesn't do any handshake and uses provided credChecker to verify user and password from the request
 func (s *Service) AddDirectProvider(name string, credChecker provider.CredChecker) {
@@ -373,6 +912,11 @@ func (s *Service) AddDirectProvider(name string, credChecker provider.CredChecke
 		TokenService: s.jwtService,
 		CredChecker:  credChecker,
 		AvatarSaver:  s.avatarProxy,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
+
+		Limits: s.providerLimits(),
 	}
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
@@ -390,13 +934,23 @@ func (s *Service) AddDirectProviderWithUserIDFunc(name string, credChecker provi
 		CredChecker:  credChecker,
 		AvatarSaver:  s.avatarProxy,
 		UserIDFunc:   ufn,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
+
+		Limits: s.providerLimits(),
 	}
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
 }
 
-// AddVerifProvider adds provider user's verification sent by sender
+// AddVerifProvider adds provider user's verification sent by sender.
+// Confirmations are one-time, used ones kept by opts.ConfirmationStore, in-memory store used if not defined.
 func (s *Service) AddVerifProvider(name, msgTmpl string, sender provider.Sender) {
+	store := s.opts.ConfirmationStore
+	if store == nil {
+		store = provider.NewMemConfirmationStore()
+	}
 	dh := provider.VerifyHandler{
 		L:            s.logger,
 		ProviderName: name,
@@ -406,11 +960,80 @@ func (s *Service) AddVerifProvider(name, msgTmpl string, sender provider.Sender)
 		Sender:       sender,
 		Template:     msgTmpl,
 		UseGravatar:  s.useGravatar,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
+
+		ConfirmationStore: store,
+
+		Limits: s.providerLimits(),
 	}
 	s.providers = append(s.providers, provider.NewService(dh))
 	s.authMiddleware.Providers = s.providers
 }
 
+// AddVerifCodeProvider adds provider user's verification with numeric code sent by sender.
+// Codes kept by opts.ConfirmationStore, in-memory store used if not defined.
+func (s *Service) AddVerifCodeProvider(name, msgTmpl string, sender provider.Sender) {
+	store := s.opts.ConfirmationStore
+	if store == nil {
+		store = provider.NewMemConfirmationStore()
+	}
+	dh := provider.VerifyHandler{
+		L:            s.logger,
+		ProviderName: name,
+		Issuer:       s.issuer,
+		TokenService: s.jwtService,
+		AvatarSaver:  s.avatarProxy,
+		Sender:       sender,
+		Template:     msgTmpl,
+		UseGravatar:  s.useGravatar,
+
+		IdentityStore: s.opts.IdentityStore,
+		SecondFactor:  s.opts.SecondFactor,
+
+		ConfirmationStore: store,
+		UseCode:           true,
+
+		Limits: s.providerLimits(),
+	}
+	s.providers = append(s.providers, provider.NewService(dh))
+	s.authMiddleware.Providers = s.providers
+}
+
+// AddWebAuthnProvider adds passwordless provider with WebAuthn (passkeys), credentials kept by store.
+// Relying party id and origin made from opts.URL, so the site should be served from the same host.
+// Used challenges kept by opts.ConfirmationStore, in-memory store used if not defined.
+func (s *Service) AddWebAuthnProvider(name string, store provider.CredentialStore) error {
+	u, err := url.Parse(s.opts.URL)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("can't make relying party of url %q", s.opts.URL)
+	}
+	confirmations := s.opts.ConfirmationStore
+	if confirmations == nil {
+		confirmations = provider.NewMemConfirmationStore()
+	}
+	wh := provider.WebAuthnHandler{
+		L:               s.logger,
+		ProviderName:    name,
+		TokenService:    s.jwtService,
+		Issuer:          s.issuer,
+		AvatarSaver:     s.avatarProxy,
+		CredentialStore: store,
+		RPID:            u.Hostname(),
+		RPName:          s.issuer,
+		Origin:          u.Scheme + "://" + u.Host,
+		SecureCookies:   s.opts.SecureCookies,
+
+		ConfirmationStore: confirmations,
+		IdentityStore:     s.opts.IdentityStore,
+		SecondFactor:      s.opts.SecondFactor,
+	}
+	s.providers = append(s.providers, provider.NewService(wh))
+	s.authMiddleware.Providers = s.providers
+	return nil
+}
+
 // AddCustomHandler adds user-defined self-implemented handler of auth provider
 func (s *Service) AddCustomHandler(handler provider.Provider) {
 	s.providers = append(s.providers, provider.NewService(handler))
@@ -437,6 +1060,20 @@ func (s *Service) Provider(name string) (provider.Service, error) {
 	return provider.Service{}, fmt.Errorf("provider %s not found", name)
 }
 
+// UpstreamClient makes http client calling api of the provider on behalf of the user,
+// with the token issued by provider on user's login. Requires Opts.UpstreamTokenStore.
+func (s *Service) UpstreamClient(ctx context.Context, providerName, userID string) (*http.Client, error) {
+	p, err := s.Provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	cm, ok := p.Provider.(provider.UpstreamClientMaker)
+	if !ok {
+		return nil, fmt.Errorf("provider %s doesn't support upstream client", providerName)
+	}
+	return cm.UpstreamClient(ctx, userID)
+}
+
 // Providers gets all registered providers
 func (s *Service) Providers() []provider.Service {
 	return s.providers
@@ -2,6 +2,8 @@ package sauth
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -9,17 +11,22 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 
 	"github.com/efureev/sauth/avatar"
+	"github.com/efureev/sauth/limit"
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	"github.com/efureev/sauth/provider"
 	"github.com/efureev/sauth/token"
 )
@@ -88,6 +95,30 @@ func TestProvider(t *testing.T) {
 	assert.Equal(t, "telegramBotMySiteCom", chp.Name())
 }
 
+func TestUpstreamClient(t *testing.T) {
+	store := provider.NewMemUpstreamTokenStore()
+	svc := NewService(Opts{
+		SecretReader:       token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		URL:                "http://127.0.0.1:8089",
+		UpstreamTokenStore: store,
+	})
+	svc.AddProvider(NewProviderConfig(`github`, `cid`, "csecret", true))
+	svc.AddCustomHandler(customHandler{})
+
+	_, err := svc.UpstreamClient(context.Background(), "github", "github_user1")
+	assert.Error(t, err, "no token stored")
+
+	require.NoError(t, store.Put("github_user1", token.UpstreamToken{Provider: "github", AccessToken: "at1"}))
+	client, err := svc.UpstreamClient(context.Background(), "github", "github_user1")
+	require.NoError(t, err)
+	assert.NotNil(t, client)
+
+	_, err = svc.UpstreamClient(context.Background(), "telegramBotMySiteCom", "user1")
+	assert.EqualError(t, err, "provider telegramBotMySiteCom doesn't support upstream client")
+	_, err = svc.UpstreamClient(context.Background(), "bad", "user1")
+	assert.EqualError(t, err, "provider bad not found")
+}
+
 func TestService_AddAppleProvider(t *testing.T) {
 
 	options := Opts{
@@ -143,6 +174,107 @@ Ivx5tHkv
 
 }
 
+func TestService_AddWebAuthnProvider(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:  token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		URL:           "https://auth.example.com:8443",
+		Logger:        logger.Std,
+		SecondFactor:  &mockSecondFactor{enrolled: map[string]bool{}},
+		IdentityStore: provider.NewMemIdentityStore(),
+	})
+	require.NoError(t, svc.AddWebAuthnProvider("passkey", provider.NewMemCredentialStore()))
+	p, err := svc.Provider("passkey")
+	require.NoError(t, err)
+	wh, ok := p.Provider.(provider.WebAuthnHandler)
+	require.True(t, ok)
+	assert.Equal(t, "auth.example.com", wh.RPID)
+	assert.Equal(t, "https://auth.example.com:8443", wh.Origin)
+	assert.NotNil(t, wh.ConfirmationStore, "challenges one-time by default")
+	assert.NotNil(t, wh.IdentityStore)
+	assert.NotNil(t, wh.SecondFactor)
+
+	svc = NewService(Opts{SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil })})
+	assert.Error(t, svc.AddWebAuthnProvider("passkey", provider.NewMemCredentialStore()), "no url")
+}
+
+func TestService_AddVerifCodeProvider(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		Logger:       logger.Std,
+	})
+	svc.AddVerifCodeProvider("code", "", provider.SenderFunc(func(string, string) error { return nil }))
+	p, err := svc.Provider("code")
+	require.NoError(t, err)
+	vh, ok := p.Provider.(provider.VerifyHandler)
+	require.True(t, ok)
+	assert.True(t, vh.UseCode)
+	assert.NotNil(t, vh.ConfirmationStore, "in-memory store by default")
+}
+
+func TestService_VerifProvidersTokenBinding(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		Logger:       logger.Std,
+		AvatarStore:  avatar.NewNoOp(),
+	})
+	var linkMsg, codeMsg string
+	svc.AddVerifProvider("email", "{{.Token}}", provider.SenderFunc(func(_, text string) error { linkMsg = text; return nil }))
+	svc.AddVerifProvider("email2", "{{.Token}}", provider.SenderFunc(func(string, string) error { return nil }))
+	svc.AddVerifCodeProvider("sms", "{{.Code}}", provider.SenderFunc(func(_, text string) error { codeMsg = text; return nil }))
+	authRoute, _ := svc.Handlers()
+	login := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		authRoute.ServeHTTP(rr, httptest.NewRequest("GET", path, http.NoBody))
+		return rr
+	}
+
+	rr := login("/auth/sms/login?user=u1&address=victim@example.com&site=remark42")
+	require.Equal(t, http.StatusOK, rr.Code)
+	res := map[string]string{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	codeToken := res["token"]
+	require.NotEmpty(t, codeToken)
+	assert.Equal(t, http.StatusForbidden, login("/auth/email/login?token="+codeToken).Code,
+		"code token rejected by link provider")
+	assert.Equal(t, http.StatusForbidden, login("/auth/sms/login?token="+codeToken).Code, "no code")
+
+	require.Equal(t, http.StatusOK, login("/auth/email/login?user=u1&address=u1@example.com&site=remark42").Code)
+	linkToken := linkMsg
+	assert.Equal(t, http.StatusForbidden, login("/auth/email2/login?token="+linkToken).Code,
+		"token of other provider rejected")
+	assert.Equal(t, http.StatusForbidden, login("/auth/sms/login?token="+linkToken+"&code="+codeMsg).Code,
+		"link token rejected by code provider")
+	assert.Equal(t, http.StatusOK, login("/auth/email/login?token="+linkToken).Code)
+	assert.Equal(t, http.StatusForbidden, login("/auth/email/login?token="+linkToken).Code, "link used already")
+	assert.Equal(t, http.StatusOK, login("/auth/sms/login?token="+codeToken+"&code="+codeMsg).Code)
+}
+
+func TestService_Limits(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		Logger:       logger.Std,
+		AvatarStore:  avatar.NewNoOp(),
+		Limits:       limit.Limits{IP: limit.NewMemLimiter(2, time.Hour), User: limit.NewMemLimiter(10, time.Hour)},
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(string, string) (bool, error) { return true, nil }))
+	p, err := svc.Provider("direct")
+	require.NoError(t, err)
+	assert.Nil(t, p.Provider.(provider.DirectHandler).Limits.IP, "ip checked by auth handler")
+	assert.NotNil(t, p.Provider.(provider.DirectHandler).Limits.User)
+
+	authRoute, _ := svc.Handlers()
+	login := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		authRoute.ServeHTTP(rr, httptest.NewRequest("GET", "/auth/direct/login?user=u1&passwd=p", http.NoBody))
+		return rr
+	}
+	assert.Equal(t, http.StatusOK, login().Code)
+	assert.Equal(t, http.StatusOK, login().Code)
+	rr := login()
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "3600", rr.Header().Get("Retry-After"))
+}
+
 func TestIntegrationProtected(t *testing.T) {
 
 	_, teardown := prepService(t)
@@ -301,6 +433,489 @@ func TestLogout(t *testing.T) {
 	assert.NoError(t, resp.Body.Close())
 }
 
+func TestLogoutRevokesToken(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:    token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:     true,
+		Logger:          logger.Std,
+		RevocationStore: token.NewMemRevocationStore(),
+		AvatarStore:     avatar.NewNoOp(),
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "JWT", resp.Cookies()[0].Name)
+	jwtCookie := resp.Cookies()[0]
+
+	getUser := func() int {
+		req, e := http.NewRequest("GET", ts.URL+"/auth/user", http.NoBody)
+		require.NoError(t, e)
+		req.AddCookie(jwtCookie)
+		r, e := http.DefaultClient.Do(req)
+		require.NoError(t, e)
+		require.NoError(t, r.Body.Close())
+		return r.StatusCode
+	}
+	assert.Equal(t, 200, getUser())
+
+	req, err := http.NewRequest("GET", ts.URL+"/auth/logout", http.NoBody)
+	require.NoError(t, err)
+	req.AddCookie(jwtCookie)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, 200, resp.StatusCode)
+
+	assert.Equal(t, 401, getUser(), "copy of logged out token rejected")
+}
+
+func TestRefreshHandler(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+		RefreshStore: token.NewMemRefreshStore(),
+		AvatarStore:  avatar.NewNoOp(),
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	refreshCookie := resp.Cookies()[0]
+	require.Equal(t, "JWT-REFRESH", refreshCookie.Name)
+
+	refresh := func(c *http.Cookie) *http.Response {
+		req, e := http.NewRequest("POST", ts.URL+"/auth/refresh", http.NoBody)
+		require.NoError(t, e)
+		req.AddCookie(c)
+		r, e := http.DefaultClient.Do(req)
+		require.NoError(t, e)
+		require.NoError(t, r.Body.Close())
+		return r
+	}
+
+	resp = refresh(refreshCookie)
+	assert.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, 3, len(resp.Cookies()))
+	assert.NotEqual(t, refreshCookie.Value, resp.Cookies()[0].Value, "rotated")
+
+	resp = refresh(refreshCookie)
+	assert.Equal(t, 401, resp.StatusCode, "reused refresh token")
+
+	resp, err = http.Get(ts.URL + "/auth/refresh")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, 405, resp.StatusCode)
+}
+
+func TestSessionsHandler(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+		SessionStore: token.NewMemSessionStore(time.Hour),
+		AvatarStore:  avatar.NewNoOp(),
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+	m := svc.Middleware()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	mux.Handle("/private", m.Auth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("private"))
+	})))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	login := func() *http.Cookie {
+		resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+		return resp.Cookies()[0]
+	}
+	do := func(method, path string, c *http.Cookie) (int, map[string]interface{}) {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		req.AddCookie(c)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res := map[string]interface{}{}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+
+	c1, c2, c3 := login(), login(), login()
+
+	code, res := do("GET", "/auth/sessions", c1)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 3, len(res["sessions"].([]interface{})))
+	claims, err := svc.TokenService().Parse(c2.Value)
+	require.NoError(t, err)
+
+	code, _ = do("DELETE", "/auth/sessions/"+claims.Id, c1)
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/private", c2)
+	assert.Equal(t, 401, code, "revoked session rejected")
+	code, res = do("GET", "/auth/status", c2)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, false, res["logged"], "revoked session not logged in")
+	code, res = do("GET", "/auth/status", c1)
+	assert.Equal(t, true, res["logged"])
+	code, _ = do("GET", "/private", c1)
+	assert.Equal(t, 200, code)
+
+	code, _ = do("DELETE", "/auth/sessions/bad-id", c1)
+	assert.Equal(t, 404, code)
+
+	code, res = do("DELETE", "/auth/sessions", c1)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 1, len(res["revoked"].([]interface{})), "all other sessions revoked")
+	code, _ = do("GET", "/private", c3)
+	assert.Equal(t, 401, code)
+	code, res = do("GET", "/auth/sessions", c1)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 1, len(res["sessions"].([]interface{})))
+
+	code, _ = do("GET", "/auth/sessions", &http.Cookie{Name: "JWT", Value: "bad"})
+	assert.Equal(t, 401, code)
+}
+
+func TestIntrospect(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:    token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		Logger:          logger.Std,
+		AvatarStore:     avatar.NewNoOp(),
+		RevocationStore: token.NewMemRevocationStore(),
+		Validator: token.ValidatorFunc(func(_ string, claims token.Claims) bool {
+			return claims.User != nil && claims.User.Name != "blocked"
+		}),
+		IntrospectionChecker: func(user, passwd string) (bool, token.User, error) {
+			return user == "api" && passwd == "secret", token.User{}, nil
+		},
+	})
+	authRoute, _ := svc.Handlers()
+	ts := httptest.NewServer(authRoute)
+	defer ts.Close()
+
+	makeToken := func(name string, exp time.Duration) string {
+		claims := token.Claims{User: &token.User{ID: "user1", Name: name, Email: "user1@example.com"},
+			StandardClaims: jwt.StandardClaims{Id: name + "-id", Audience: "site1", Issuer: "sauth",
+				ExpiresAt: time.Now().Add(exp).Unix(), IssuedAt: time.Now().Unix()}}
+		tkn, err := svc.TokenService().Token(claims)
+		require.NoError(t, err)
+		return tkn
+	}
+	introspect := func(tkn, client string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", ts.URL+"/auth/introspect", strings.NewReader(url.Values{"token": {tkn}}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client, "secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res := map[string]interface{}{}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+
+	code, res := introspect(makeToken("user", time.Hour), "api")
+	require.Equal(t, 200, code)
+	assert.Equal(t, true, res["active"])
+	assert.Equal(t, "user1", res["sub"])
+	assert.Equal(t, "site1", res["aud"])
+	assert.Equal(t, "sauth", res["iss"])
+	assert.Equal(t, "user1@example.com", res["email"])
+	assert.NotZero(t, res["exp"])
+	assert.NotZero(t, res["iat"])
+
+	for name, tkn := range map[string]string{
+		"expired": makeToken("user", -time.Hour),
+		"blocked": makeToken("blocked", time.Hour),
+		"broken":  "bad token",
+	} {
+		code, res = introspect(tkn, "api")
+		assert.Equal(t, 200, code, name)
+		assert.Equal(t, map[string]interface{}{"active": false}, res, name)
+	}
+
+	tkn := makeToken("revoked", time.Hour)
+	claims, err := svc.TokenService().Parse(tkn)
+	require.NoError(t, err)
+	require.NoError(t, svc.TokenService().Revoke(claims))
+	_, res = introspect(tkn, "api")
+	assert.Equal(t, false, res["active"], "revoked")
+
+	code, _ = introspect(makeToken("user", time.Hour), "bad")
+	assert.Equal(t, 401, code)
+	code, _ = introspect("", "api")
+	assert.Equal(t, 400, code)
+
+	resp, err := http.Get(ts.URL + "/auth/introspect")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, 405, resp.StatusCode)
+}
+
+func TestLinkIdentity(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader:  token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:   true,
+		Logger:        logger.Std,
+		IdentityStore: provider.NewMemIdentityStore(),
+		AvatarStore:   avatar.NewNoOp(),
+	})
+	creds := provider.CredCheckerFunc(func(user, password string) (ok bool, err error) { return password == "password", nil })
+	svc.AddDirectProvider("direct", creds)
+	svc.AddDirectProvider("direct2", creds)
+	authRoute, _ := svc.Handlers()
+	ts := httptest.NewServer(authRoute)
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path string, cookies ...*http.Cookie) (*http.Response, string) {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	userID := func(body string) string {
+		u := token.User{}
+		require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+		return u.ID
+	}
+
+	resp, body := do("GET", "/auth/direct/login?user=user1&passwd=password")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	user1, jwtCookie := userID(body), resp.Cookies()[0]
+	resp, body = do("GET", "/auth/direct2/login?user=user2&passwd=password")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	user2 := userID(body)
+
+	// link requires logged-in user
+	resp, _ = do("GET", "/auth/direct2/link?user=user2&passwd=password")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = do("GET", "/auth/direct2/link?user=user2&passwd=password", jwtCookie)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "/auth/direct2/login?user=user2&passwd=password", resp.Header.Get("Location"))
+	linkCookie := resp.Cookies()[0]
+	assert.Equal(t, provider.LinkCookieName, linkCookie.Name)
+
+	// login with link cookie links direct2 user to user1 and issues token for user1
+	resp, body = do("GET", resp.Header.Get("Location"), linkCookie)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Equal(t, user1, userID(body))
+
+	// login with the linked provider resolved to user1
+	resp, body = do("GET", "/auth/direct2/login?user=user2&passwd=password")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Equal(t, user1, userID(body))
+
+	resp, body = do("GET", "/auth/identities", jwtCookie)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ids := []provider.Identity{}
+	require.NoError(t, json.Unmarshal([]byte(body), &ids))
+	require.Equal(t, 1, len(ids))
+	assert.Equal(t, provider.Identity{UserID: user1, Provider: "direct2", ProviderID: user2, LinkedAt: ids[0].LinkedAt}, ids[0])
+
+	// user3 can't link identity linked to user1
+	resp, body = do("GET", "/auth/direct/login?user=user3&passwd=password")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	resp, _ = do("GET", "/auth/direct2/link?user=user2&passwd=password", resp.Cookies()[0])
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp, _ = do("GET", resp.Header.Get("Location"), resp.Cookies()[0])
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// unlink
+	resp, _ = do("GET", "/auth/direct2/unlink", jwtCookie)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, _ = do("DELETE", "/auth/direct2/unlink", jwtCookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body = do("GET", "/auth/direct2/login?user=user2&passwd=password")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Equal(t, user2, userID(body))
+
+	resp, _ = do("GET", "/auth/unknown/link", jwtCookie)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSecondFactor(t *testing.T) {
+	sf := &mockSecondFactor{enrolled: map[string]bool{}}
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+		AvatarStore:  avatar.NewNoOp(),
+		SecondFactor: sf,
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+	m := svc.Middleware()
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	mux.Handle("/private", m.Auth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("private"))
+	})))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	login := func() *http.Cookie {
+		resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+		return resp.Cookies()[0]
+	}
+	do := func(method, path string, c *http.Cookie) (int, map[string]interface{}, []*http.Cookie) {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		req.AddCookie(c)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		res := map[string]interface{}{}
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res, resp.Cookies()
+	}
+
+	full := login()
+	code, _, _ := do("GET", "/private", full)
+	assert.Equal(t, 200, code, "not enrolled, second factor not required")
+
+	code, res, _ := do("POST", "/auth/mfa/enroll", full)
+	require.Equal(t, 200, code)
+	assert.Equal(t, "otpauth://totp/test:dev_direct", res["uri"])
+	code, _, _ = do("POST", "/auth/mfa/verify?code=000000", full)
+	assert.Equal(t, 403, code)
+	code, res, _ = do("POST", "/auth/mfa/verify?code=123456", full)
+	require.Equal(t, 200, code)
+	assert.Equal(t, true, res["enrolled"])
+	code, _, _ = do("POST", "/auth/mfa/enroll", full)
+	assert.Equal(t, 409, code)
+
+	pending := login()
+	claims, err := svc.TokenService().Parse(pending.Value)
+	require.NoError(t, err)
+	assert.True(t, claims.MFARequired)
+	assert.True(t, time.Unix(claims.ExpiresAt, 0).Before(time.Now().Add(6*time.Minute)))
+	code, _, _ = do("GET", "/private", pending)
+	assert.Equal(t, 401, code, "pending token rejected")
+	code, res, _ = do("GET", "/auth/status", pending)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, true, res["mfa_required"])
+	code, _, _ = do("POST", "/auth/mfa/enroll", pending)
+	assert.Equal(t, 401, code)
+	code, _, _ = do("POST", "/auth/mfa/verify?code=000000", pending)
+	assert.Equal(t, 403, code)
+
+	code, res, cookies := do("POST", "/auth/mfa/verify?code=123456", pending)
+	require.Equal(t, 200, code)
+	assert.Equal(t, "dev_direct", res["name"])
+	claims, err = svc.TokenService().Parse(cookies[0].Value)
+	require.NoError(t, err)
+	assert.False(t, claims.MFARequired)
+	assert.Equal(t, []string{token.AMRPassword, token.AMROTP}, claims.AMR)
+	assert.NotZero(t, claims.AuthTime)
+	code, _, _ = do("GET", "/private", cookies[0])
+	assert.Equal(t, 200, code)
+
+	code, _, _ = do("GET", "/auth/mfa/verify?code=123456", pending)
+	assert.Equal(t, 405, code)
+}
+
+func TestSecondFactor_Attempts(t *testing.T) {
+	sf := &mockSecondFactor{enrolled: map[string]bool{}}
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+		AvatarStore:  avatar.NewNoOp(),
+		SecondFactor: sf,
+	})
+	svc.AddDirectProvider("direct", provider.CredCheckerFunc(func(user, password string) (ok bool, err error) {
+		return user == "dev_direct" && password == "password", nil
+	}))
+	authRoute, _ := svc.Handlers()
+	ts := httptest.NewServer(authRoute)
+	defer ts.Close()
+
+	login := func() *http.Cookie {
+		resp, err := http.Get(ts.URL + "/auth/direct/login?user=dev_direct&passwd=password")
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+		return resp.Cookies()[0]
+	}
+	verify := func(c *http.Cookie, code string) (int, []*http.Cookie) {
+		req, err := http.NewRequest("POST", ts.URL+"/auth/mfa/verify?code="+code, http.NoBody)
+		require.NoError(t, err)
+		req.AddCookie(c)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, resp.Cookies()
+	}
+
+	claims, err := svc.TokenService().Parse(login().Value)
+	require.NoError(t, err)
+	sf.enrolled[claims.User.ID] = true
+
+	pending := login()
+	for i := 1; i < mfaMaxTokenAttempts; i++ {
+		code, cookies := verify(pending, "000000")
+		assert.Equal(t, 403, code)
+		assert.Empty(t, cookies)
+	}
+	code, cookies := verify(pending, "000000")
+	assert.Equal(t, 403, code)
+	require.NotEmpty(t, cookies, "pending token burned")
+	assert.Equal(t, "JWT", cookies[0].Name)
+	assert.Equal(t, "", cookies[0].Value)
+	code, _ = verify(pending, "123456")
+	assert.Equal(t, 429, code, "burned token rejected with valid code")
+
+	pending = login()
+	for i := mfaMaxTokenAttempts; i < mfaMaxUserAttempts; i++ {
+		code, _ = verify(pending, "000000")
+		assert.Equal(t, 403, code)
+	}
+	code, _ = verify(login(), "123456")
+	assert.Equal(t, 429, code, "user capped across tokens")
+}
+
 func TestLogoutNoProviders(t *testing.T) {
 	svc := NewService(Opts{Logger: logger.Std})
 	authRoute, _ := svc.Handlers()
@@ -319,6 +934,40 @@ func TestLogoutNoProviders(t *testing.T) {
 	assert.Equal(t, "{\"error\":\"provides not defined\"}\n", string(b))
 }
 
+func TestJWKS(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := token.NewKey("k1", edKey)
+	require.NoError(t, err)
+
+	svc := NewService(Opts{Logger: logger.Std, KeySet: token.NewStaticKeySet(key), JWKSMaxAge: time.Minute})
+	authRoute, _ := svc.Handlers()
+
+	mux := http.NewServeMux()
+	mux.Handle("/auth/", authRoute)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, path := range []string{"/auth/jwks", "/auth/.well-known/jwks.json"} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "public, max-age=60", resp.Header.Get("Cache-Control"))
+		jwks := token.JWKS{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, 1, len(jwks.Keys))
+		assert.Equal(t, "k1", jwks.Keys[0].ID)
+		assert.Equal(t, "EdDSA", jwks.Keys[0].Algorithm)
+	}
+
+	svc = NewService(Opts{Logger: logger.Std})
+	authRoute, _ = svc.Handlers()
+	resp := httptest.NewRecorder()
+	authRoute.ServeHTTP(resp, httptest.NewRequest("GET", "/auth/jwks", http.NoBody))
+	assert.Equal(t, 404, resp.Code)
+}
+
 func TestBadRequests(t *testing.T) {
 	_, teardown := prepService(t)
 	defer teardown()
@@ -489,6 +1138,28 @@ func TestStatus(t *testing.T) {
 
 }
 
+func TestService_HandshakeTokenNotLoggedIn(t *testing.T) {
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+	})
+	authRoute, _ := svc.Handlers()
+	tkn, err := svc.TokenService().Token(token.Claims{User: &token.User{ID: "u1", Name: "admin"},
+		Handshake:      &token.Handshake{State: "challenge"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	require.NoError(t, err)
+
+	for _, path := range []string{"/auth/user", "/auth/status"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "JWT", Value: tkn})
+		authRoute.ServeHTTP(rr, req)
+		assert.NotContains(t, rr.Body.String(), "admin", path)
+		assert.NotContains(t, rr.Body.String(), `"logged":true`, path)
+	}
+}
+
 func prepService(t *testing.T) (svc *Service, teardown func()) { //nolint unparam
 
 	options := Opts{
@@ -587,6 +1258,78 @@ func (m *mockSender) Send(to, text string) error {
 	return nil
 }
 
+func TestSecondFactor_CustomProvider(t *testing.T) {
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = w.Write([]byte(`{"access_token":"access","token_type":"bearer","expires_in":3600}`))
+		case "/info":
+			_, _ = w.Write([]byte(`{"id":"u1","name":"custom user"}`))
+		}
+	}))
+	defer oauth.Close()
+
+	sf := &mockSecondFactor{enrolled: map[string]bool{"custom_u1": true}}
+	svc := NewService(Opts{
+		SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+		DisableXSRF:  true,
+		Logger:       logger.Std,
+		AvatarStore:  avatar.NewNoOp(),
+		URL:          "http://127.0.0.1",
+		SecondFactor: sf,
+	})
+	mapUser := func(_ context.Context, _ *token.UserData, raw interface{}, _ []byte) token.User {
+		data := raw.(map[string]interface{})
+		return token.User{ID: "custom_" + data["id"].(string), Name: data["name"].(string)}
+	}
+	svc.AddCustomProvider("custom", Client{Cid: "cid", Csecret: "csecret"}, provider.CustomHandlerOpt{
+		Endpoint:       oauth2.Endpoint{AuthURL: oauth.URL + "/auth", TokenURL: oauth.URL + "/token"},
+		InfoUrlMappers: []provider.Oauth2Mapper{provider.NewOauth2Mapper(oauth.URL+"/info", mapUser, map[string]interface{}{})},
+	})
+
+	handshake, err := svc.TokenService().Token(token.Claims{Handshake: &token.Handshake{State: "state"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/auth/custom/callback?state=state&code=code", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: handshake})
+	rr := httptest.NewRecorder()
+	authRoute, _ := svc.Handlers()
+	authRoute.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	claims, err := svc.TokenService().Parse(rr.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "custom_u1", claims.User.ID)
+	assert.True(t, claims.MFARequired, "second factor required for custom oauth2 provider")
+
+	svc.AddDevProvider(18090)
+	p, err := svc.Provider("dev")
+	require.NoError(t, err)
+	assert.NotNil(t, p.Provider.(provider.Oauth2Handler).SecondFactor, "dev provider")
+}
+
+type mockSecondFactor struct {
+	enrolled map[string]bool
+}
+
+func (m *mockSecondFactor) Enrolled(userID string) (bool, error) { return m.enrolled[userID], nil }
+
+func (m *mockSecondFactor) Enroll(userID, account string) (mfa.Enrollment, error) {
+	if m.enrolled[userID] {
+		return mfa.Enrollment{}, mfa.EnrolledError
+	}
+	return mfa.Enrollment{URI: "otpauth://totp/test:" + account}, nil
+}
+
+func (m *mockSecondFactor) Verify(userID, code string) (bool, error) {
+	if code != "123456" {
+		return false, nil
+	}
+	m.enrolled[userID] = true
+	return true, nil
+}
+
 type customHandler struct{}
 
 func (c customHandler) Name() string {
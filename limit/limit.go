@@ -0,0 +1,135 @@
+// Package limit provides rate limiting of login attempts and lockout of users after repeated password failures.
+package limit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limiter defines interface of rate limiter keeping bucket of tokens per key
+type Limiter interface {
+	// Allow takes a token from the bucket of key, returns false and time to wait if the bucket is empty
+	Allow(key string) (ok bool, retryAfter time.Duration, err error)
+}
+
+// LimiterFunc type is an adapter to allow the use of ordinary functions as Limiter.
+type LimiterFunc func(key string) (ok bool, retryAfter time.Duration, err error)
+
+// Allow calls f(key) to implement Limiter interface
+func (f LimiterFunc) Allow(key string) (ok bool, retryAfter time.Duration, err error) {
+	return f(key)
+}
+
+// Limits groups limiters of login attempts, any of them can be nil to skip the check
+type Limits struct {
+	IP      Limiter // per client ip
+	User    Limiter // per user name
+	Address Limiter // per target address of confirmations
+	Lockout Lockout // progressive lockout of users after failed passwords
+}
+
+// Check takes tokens for ip, user and address, empty values skipped.
+// Returns zero if all allowed, otherwise the longest time to wait.
+func (l Limits) Check(ip, user, address string) (retryAfter time.Duration, err error) {
+	checks := []struct {
+		lim Limiter
+		key string
+	}{{l.IP, ip}, {l.User, user}, {l.Address, address}}
+
+	for _, c := range checks {
+		if c.lim == nil || c.key == "" {
+			continue
+		}
+		ok, wait, err := c.lim.Allow(c.key)
+		if err != nil {
+			return 0, fmt.Errorf("can't check limit of %s: %w", c.key, err)
+		}
+		if ok {
+			continue
+		}
+		if wait <= 0 {
+			wait = time.Second
+		}
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// SetRetryAfter sets Retry-After header in seconds, rounded up
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// MemLimiter implements Limiter with token buckets in memory, thread safe.
+// Each bucket holds up to burst tokens and gets one token every period.
+type MemLimiter struct {
+	burst  int
+	every  time.Duration
+	now    func() time.Time
+	lock   sync.Mutex
+	bucket map[string]*bucket
+	swept  time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemLimiter makes in-memory limiter allowing burst of requests per key and one more every period
+func NewMemLimiter(burst int, every time.Duration) *MemLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &MemLimiter{burst: burst, every: every, now: time.Now, bucket: map[string]*bucket{}}
+}
+
+// Allow takes a token from the bucket of key
+func (m *MemLimiter) Allow(key string) (ok bool, retryAfter time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, found := m.bucket[key]
+	if !found {
+		b = &bucket{tokens: float64(m.burst), updated: now}
+		m.bucket[key] = b
+	}
+	b.tokens = m.refill(b, now)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(m.every)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// refill returns tokens of the bucket at given time
+func (m *MemLimiter) refill(b *bucket, now time.Time) float64 {
+	if m.every <= 0 {
+		return float64(m.burst)
+	}
+	return math.Min(float64(m.burst), b.tokens+float64(now.Sub(b.updated))/float64(m.every))
+}
+
+// sweep drops full buckets once in a while, should be called under lock
+func (m *MemLimiter) sweep(now time.Time) {
+	if now.Sub(m.swept) < m.every*time.Duration(m.burst) {
+		return
+	}
+	m.swept = now
+	for k, b := range m.bucket {
+		if m.refill(b, now) >= float64(m.burst) {
+			delete(m.bucket, k)
+		}
+	}
+}
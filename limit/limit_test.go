@@ -0,0 +1,121 @@
+package limit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := NewMemLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, _, err := l.Allow("k1")
+		require.NoError(t, err)
+		assert.True(t, ok, "burst %d", i)
+	}
+	ok, wait, err := l.Allow("k1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+
+	ok, _, err = l.Allow("k2")
+	require.NoError(t, err)
+	assert.True(t, ok, "separate bucket")
+
+	now = now.Add(30 * time.Second)
+	ok, wait, err = l.Allow("k1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	now = now.Add(30 * time.Second)
+	ok, _, err = l.Allow("k1")
+	require.NoError(t, err)
+	assert.True(t, ok, "refilled")
+
+	now = now.Add(time.Hour)
+	_, _, err = l.Allow("k3")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(l.bucket), "full buckets swept")
+}
+
+func TestLimits_Check(t *testing.T) {
+	deny := func(d time.Duration) Limiter {
+		return LimiterFunc(func(string) (bool, time.Duration, error) { return false, d, nil })
+	}
+	allow := LimiterFunc(func(string) (bool, time.Duration, error) { return true, 0, nil })
+
+	wait, err := Limits{}.Check("ip", "user", "addr")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait, "no limiters")
+
+	wait, err = Limits{IP: allow, User: deny(time.Minute), Address: deny(time.Hour)}.Check("ip", "user", "addr")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, wait, "the longest wait")
+
+	wait, err = Limits{IP: allow, Address: deny(time.Hour)}.Check("ip", "user", "")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait, "empty address skipped")
+
+	wait, err = Limits{User: deny(0)}.Check("", "user", "")
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+
+	_, err = Limits{IP: LimiterFunc(func(string) (bool, time.Duration, error) {
+		return false, 0, fmt.Errorf("err")
+	})}.Check("ip", "", "")
+	assert.Error(t, err)
+
+	rr := httptest.NewRecorder()
+	SetRetryAfter(rr, 1500*time.Millisecond)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+}
+
+func TestMemLockout(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := NewMemLockout(3, time.Minute, 5*time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		wait, err := l.Fail("u1")
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, err := l.Locked("u1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait, "not locked yet")
+
+	for _, exp := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		wait, err = l.Fail("u1")
+		require.NoError(t, err)
+		assert.Equal(t, exp, wait, "progressive lock")
+	}
+	now = now.Add(time.Minute)
+	wait, err = l.Locked("u1")
+	require.NoError(t, err)
+	assert.Equal(t, 4*time.Minute, wait)
+	wait, err = l.Locked("u2")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait)
+
+	require.NoError(t, l.Reset("u1"))
+	wait, err = l.Locked("u1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait, "reset")
+
+	for i := 0; i < 2; i++ {
+		_, err = l.Fail("u1")
+		require.NoError(t, err)
+	}
+	now = now.Add(25 * time.Hour)
+	wait, err = l.Fail("u1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait, "old failures forgotten")
+}
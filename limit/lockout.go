@@ -0,0 +1,103 @@
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// lockoutForget defines time after the last failure when failures of the user forgotten
+const lockoutForget = 24 * time.Hour
+
+// Lockout defines interface of progressive lockout of users after repeated password failures
+type Lockout interface {
+	// Locked returns remaining time of the user's lock, zero if not locked
+	Locked(user string) (time.Duration, error)
+	// Fail records failed attempt, returns duration of the lock caused by it, zero if not locked yet
+	Fail(user string) (time.Duration, error)
+	// Reset forgets failed attempts of the user, called after successful login
+	Reset(user string) error
+}
+
+// MemLockout implements Lockout in memory, thread safe. User locked after threshold of failures for base duration,
+// each next failure doubles the lock up to max. Failures forgotten on success or a day after the last one.
+type MemLockout struct {
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	now       func() time.Time
+	lock      sync.Mutex
+	users     map[string]*failures
+}
+
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time // locked till
+}
+
+// NewMemLockout makes in-memory lockout
+func NewMemLockout(threshold int, base, max time.Duration) *MemLockout {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if max < base {
+		max = base
+	}
+	return &MemLockout{threshold: threshold, base: base, max: max, now: time.Now, users: map[string]*failures{}}
+}
+
+// Locked returns remaining time of the user's lock
+func (m *MemLockout) Locked(user string) (time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f, ok := m.users[user]
+	if !ok {
+		return 0, nil
+	}
+	if wait := f.locked.Sub(m.now()); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Fail records failed attempt
+func (m *MemLockout) Fail(user string) (time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	for u, f := range m.users {
+		if now.Sub(f.last) > lockoutForget {
+			delete(m.users, u)
+		}
+	}
+
+	f, ok := m.users[user]
+	if !ok {
+		f = &failures{}
+		m.users[user] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < m.threshold {
+		return 0, nil
+	}
+
+	lock := m.base
+	for i := m.threshold; i < f.count && lock < m.max; i++ {
+		lock *= 2
+	}
+	if lock > m.max {
+		lock = m.max
+	}
+	f.locked = now.Add(lock)
+	return lock, nil
+}
+
+// Reset forgets failed attempts of the user
+func (m *MemLockout) Reset(user string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.users, user)
+	return nil
+}
@@ -0,0 +1,60 @@
+package mfa
+
+import (
+	"sync"
+	"time"
+)
+
+// Attempts counts failed verifications per key (i.e. token id or user id) within a window, thread safe.
+// Key with max failures rejected till the window of its first failure passed.
+type Attempts struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+	lock   sync.Mutex
+	keys   map[string]*failures
+}
+
+type failures struct {
+	count int
+	since time.Time
+}
+
+// NewAttempts makes counter allowing max failures per key within window
+func NewAttempts(max int, window time.Duration) *Attempts {
+	return &Attempts{max: max, window: window, now: time.Now, keys: map[string]*failures{}}
+}
+
+// Exceeded checks if the key has max failures already
+func (a *Attempts) Exceeded(key string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	f, ok := a.keys[key]
+	return ok && a.now().Sub(f.since) < a.window && f.count >= a.max
+}
+
+// Fail records failure of the key, returns true if max failures reached with it
+func (a *Attempts) Fail(key string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.now()
+	for k, f := range a.keys {
+		if now.Sub(f.since) >= a.window {
+			delete(a.keys, k)
+		}
+	}
+	f, ok := a.keys[key]
+	if !ok {
+		f = &failures{since: now}
+		a.keys[key] = f
+	}
+	f.count++
+	return f.count >= a.max
+}
+
+// Reset forgets failures of the key
+func (a *Attempts) Reset(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.keys, key)
+}
@@ -0,0 +1,31 @@
+package mfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttempts(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	a := NewAttempts(3, time.Minute)
+	a.now = func() time.Time { return now }
+
+	assert.False(t, a.Exceeded("k1"))
+	assert.False(t, a.Fail("k1"))
+	assert.False(t, a.Fail("k1"))
+	assert.False(t, a.Exceeded("k1"))
+	assert.True(t, a.Fail("k1"), "max reached")
+	assert.True(t, a.Exceeded("k1"))
+	assert.False(t, a.Exceeded("k2"), "other key not affected")
+
+	now = now.Add(time.Minute)
+	assert.False(t, a.Exceeded("k1"), "window passed")
+	assert.False(t, a.Fail("k1"), "counted from scratch")
+
+	a.Fail("k1")
+	a.Reset("k1")
+	assert.False(t, a.Fail("k1"))
+	assert.False(t, a.Exceeded("k1"))
+}
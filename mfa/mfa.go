@@ -0,0 +1,68 @@
+// Package mfa provides second factors of authentication, verified after the first one passed with any provider.
+package mfa
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EnrolledError returned by SecondFactor.Enroll for user with confirmed second factor already
+var EnrolledError = fmt.Errorf("second factor enrolled already")
+
+// SecondFactor defines interface of second step of authentication
+type SecondFactor interface {
+	// Enrolled checks if user has confirmed second factor, so it's required on login
+	Enrolled(userID string) (bool, error)
+	// Enroll starts enrollment, the factor isn't required until confirmed by the first valid code
+	Enroll(userID, account string) (Enrollment, error)
+	// Verify checks the code or one of recovery codes, valid code confirms pending enrollment
+	Verify(userID, code string) (bool, error)
+}
+
+// Enrollment returned to the user once, on start of enrollment
+type Enrollment struct {
+	Secret        string   `json:"secret"`         // base32 encoded secret for manual entry
+	URI           string   `json:"uri"`            // otpauth:// key uri, usually shown as qr code
+	RecoveryCodes []string `json:"recovery_codes"` // one-time codes to pass second step without device
+}
+
+// Secret is a second factor secret of the user, kept by Store
+type Secret struct {
+	Key           string   `json:"key"`            // base32 encoded
+	Confirmed     bool     `json:"confirmed"`      // set by the first valid code
+	RecoveryCodes []string `json:"recovery_codes"` // sha256 hashes of unused recovery codes
+	LastStep      int64    `json:"last_step"`      // time step of the last accepted code, older and same rejected
+}
+
+// Store defines interface keeping secrets of users
+type Store interface {
+	// Get returns secret of the user, empty secret if not enrolled
+	Get(userID string) (Secret, error)
+	Put(userID string, s Secret) error
+}
+
+// MemStore implements Store in memory, thread safe
+type MemStore struct {
+	lock    sync.Mutex
+	secrets map[string]Secret
+}
+
+// NewMemStore makes in-memory store of secrets
+func NewMemStore() *MemStore {
+	return &MemStore{secrets: map[string]Secret{}}
+}
+
+// Get returns secret of the user
+func (m *MemStore) Get(userID string) (Secret, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.secrets[userID], nil
+}
+
+// Put saves secret of the user
+func (m *MemStore) Put(userID string, s Secret) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.secrets[userID] = s
+	return nil
+}
@@ -0,0 +1,186 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpPeriod        = 30 // seconds
+	totpDigits        = 6
+	totpSkew          = 1 // steps tolerated before and after current one
+	recoveryCodeCount = 8
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP implements SecondFactor with time-based one-time passwords, RFC 6238 (HMAC-SHA1, 6 digits, 30 seconds),
+// compatible with common authenticator apps. Verifications of the same user serialized, so a code can't be used twice
+// by concurrent requests. Instances sharing the store don't see locks of each other.
+type TOTP struct {
+	Issuer string // shown by authenticator apps, i.e. application name
+	Store  Store
+	now    func() time.Time
+
+	lock  sync.Mutex
+	users map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewTOTP makes TOTP second factor with secrets kept in store
+func NewTOTP(issuer string, store Store) *TOTP {
+	return &TOTP{Issuer: issuer, Store: store, now: time.Now, users: map[string]*userLock{}}
+}
+
+// lockUser locks the user till returned unlock called, the lock dropped when nobody waits for it
+func (t *TOTP) lockUser(userID string) (unlock func()) {
+	t.lock.Lock()
+	l, ok := t.users[userID]
+	if !ok {
+		l = &userLock{}
+		t.users[userID] = l
+	}
+	l.refs++
+	t.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		t.lock.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(t.users, userID)
+		}
+		t.lock.Unlock()
+	}
+}
+
+// Enrolled checks if user confirmed TOTP secret
+func (t *TOTP) Enrolled(userID string) (bool, error) {
+	s, err := t.Store.Get(userID)
+	if err != nil {
+		return false, fmt.Errorf("can't get secret: %w", err)
+	}
+	return s.Key != "" && s.Confirmed, nil
+}
+
+// Enroll makes new secret and recovery codes, replacing unconfirmed ones
+func (t *TOTP) Enroll(userID, account string) (Enrollment, error) {
+	if enrolled, err := t.Enrolled(userID); err != nil || enrolled {
+		if err == nil {
+			err = EnrolledError
+		}
+		return Enrollment{}, err
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return Enrollment{}, fmt.Errorf("can't make secret: %w", err)
+	}
+	res := Enrollment{Secret: b32.EncodeToString(key)}
+	s := Secret{Key: res.Secret}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := make([]byte, 5)
+		if _, err := rand.Read(code); err != nil {
+			return Enrollment{}, fmt.Errorf("can't make recovery code: %w", err)
+		}
+		c := hex.EncodeToString(code)
+		res.RecoveryCodes = append(res.RecoveryCodes, c[:5]+"-"+c[5:])
+		s.RecoveryCodes = append(s.RecoveryCodes, hashCode(c))
+	}
+	if err := t.Store.Put(userID, s); err != nil {
+		return Enrollment{}, fmt.Errorf("can't save secret: %w", err)
+	}
+
+	label := url.PathEscape(account)
+	if t.Issuer != "" {
+		label = url.PathEscape(t.Issuer) + ":" + label
+	}
+	q := url.Values{"secret": {res.Secret}, "algorithm": {"SHA1"}, "digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(totpPeriod)}}
+	if t.Issuer != "" {
+		q.Set("issuer", t.Issuer)
+	}
+	res.URI = "otpauth://totp/" + label + "?" + q.Encode()
+	return res, nil
+}
+
+// Verify checks TOTP code or recovery code, used codes rejected
+func (t *TOTP) Verify(userID, code string) (bool, error) {
+	defer t.lockUser(userID)()
+
+	s, err := t.Store.Get(userID)
+	if err != nil {
+		return false, fmt.Errorf("can't get secret: %w", err)
+	}
+	if s.Key == "" {
+		return false, nil
+	}
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+
+	if len(code) == totpDigits {
+		key, err := b32.DecodeString(s.Key)
+		if err != nil {
+			return false, fmt.Errorf("invalid secret: %w", err)
+		}
+		current := t.now().Unix() / totpPeriod
+		for step := current - totpSkew; step <= current+totpSkew; step++ {
+			if step <= s.LastStep || subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) != 1 {
+				continue
+			}
+			s.LastStep, s.Confirmed = step, true
+			if err = t.Store.Put(userID, s); err != nil {
+				return false, fmt.Errorf("can't save secret: %w", err)
+			}
+			return true, nil
+		}
+		return false, nil
+	}
+
+	if !s.Confirmed { // recovery codes are not accepted for enrollment
+		return false, nil
+	}
+	hashed := hashCode(code)
+	for i, rc := range s.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(hashed)) != 1 {
+			continue
+		}
+		s.RecoveryCodes = append(s.RecoveryCodes[:i:i], s.RecoveryCodes[i+1:]...)
+		if err = t.Store.Put(userID, s); err != nil {
+			return false, fmt.Errorf("can't save secret: %w", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// totpCode makes code for time step, RFC 4226 dynamic truncation
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", bin%1000000)
+}
+
+func hashCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
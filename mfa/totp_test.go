@@ -0,0 +1,119 @@
+package mfa
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP_Code(t *testing.T) {
+	// RFC 6238 test vectors, last 6 digits
+	key := []byte("12345678901234567890")
+	assert.Equal(t, "287082", totpCode(key, 59/30))
+	assert.Equal(t, "081804", totpCode(key, 1111111109/30))
+	assert.Equal(t, "005924", totpCode(key, 1234567890/30))
+}
+
+func TestTOTP_EnrollAndVerify(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tp := NewTOTP("My App", NewMemStore())
+	tp.now = func() time.Time { return now }
+
+	enrolled, err := tp.Enrolled("u1")
+	require.NoError(t, err)
+	assert.False(t, enrolled)
+	ok, err := tp.Verify("u1", "123456")
+	require.NoError(t, err)
+	assert.False(t, ok, "not enrolled")
+
+	e, err := tp.Enroll("u1", "me@example.com")
+	require.NoError(t, err)
+	assert.Len(t, e.RecoveryCodes, 8)
+	u, err := url.Parse(e.URI)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "/My App:me@example.com", u.Path)
+	assert.Equal(t, e.Secret, u.Query().Get("secret"))
+	assert.Equal(t, "My App", u.Query().Get("issuer"))
+
+	enrolled, err = tp.Enrolled("u1")
+	require.NoError(t, err)
+	assert.False(t, enrolled, "not confirmed yet")
+	ok, err = tp.Verify("u1", e.RecoveryCodes[0])
+	require.NoError(t, err)
+	assert.False(t, ok, "recovery code doesn't confirm enrollment")
+
+	key, err := b32.DecodeString(e.Secret)
+	require.NoError(t, err)
+	ok, err = tp.Verify("u1", totpCode(key, now.Unix()/30-1))
+	require.NoError(t, err)
+	assert.True(t, ok, "previous step accepted")
+	enrolled, err = tp.Enrolled("u1")
+	require.NoError(t, err)
+	assert.True(t, enrolled)
+
+	_, err = tp.Enroll("u1", "me@example.com")
+	assert.Equal(t, EnrolledError, err)
+
+	ok, err = tp.Verify("u1", totpCode(key, now.Unix()/30-1))
+	require.NoError(t, err)
+	assert.False(t, ok, "replayed code")
+	ok, err = tp.Verify("u1", totpCode(key, now.Unix()/30+2))
+	require.NoError(t, err)
+	assert.False(t, ok, "too far in future")
+	ok, err = tp.Verify("u1", totpCode(key, now.Unix()/30))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = tp.Verify("u1", strings.ToUpper(e.RecoveryCodes[3]))
+	require.NoError(t, err)
+	assert.True(t, ok, "recovery code")
+	ok, err = tp.Verify("u1", e.RecoveryCodes[3])
+	require.NoError(t, err)
+	assert.False(t, ok, "recovery code used")
+	ok, err = tp.Verify("u1", "00000-00000")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTOTP_VerifyConcurrent(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tp := NewTOTP("My App", slowStore{NewMemStore()})
+	tp.now = func() time.Time { return now }
+	e, err := tp.Enroll("u1", "me@example.com")
+	require.NoError(t, err)
+	key, err := b32.DecodeString(e.Secret)
+	require.NoError(t, err)
+	code := totpCode(key, now.Unix()/30)
+
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := tp.Verify("u1", code)
+			assert.NoError(t, err)
+			if ok {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), accepted, "code accepted once")
+	assert.Empty(t, tp.users, "locks dropped")
+}
+
+// slowStore delays writes, so concurrent verifications overlap
+type slowStore struct{ Store }
+
+func (s slowStore) Put(userID string, secret Secret) error {
+	time.Sleep(10 * time.Millisecond)
+	return s.Store.Put(userID, secret)
+}
@@ -6,13 +6,17 @@ package middleware
 
 import (
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/efureev/sauth/logger"
 	"github.com/efureev/sauth/provider"
 	"github.com/efureev/sauth/token"
+	"github.com/go-pkgz/rest/realip"
+	"github.com/golang-jwt/jwt"
 )
 
 // Authenticator is top level auth object providing middlewares
@@ -24,6 +28,10 @@ type Authenticator struct {
 	AdminPasswd      string
 	BasicAuthChecker BasicAuthFunc
 	RefreshCache     RefreshCache
+	SilentRefresh    bool               // re-issue expired token while cookie alive, disabled by default in favor of refresh tokens
+	SessionStore     token.SessionStore // optional store of sessions, tokens of revoked sessions rejected
+	Roles            *token.RoleTable   // optional role hierarchy and permissions, used by RBAC and RequirePermission
+	DecisionLog      DecisionLogger     // optional log of policy decisions, denials logged with DEBUG level if not set
 }
 
 // RefreshCache defines interface storing and retrieving refreshed tokens
@@ -73,6 +81,7 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 			return
 		}
 		a.Logf("[DEBUG] auth failed, %v", err)
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 	}
 
@@ -82,6 +91,7 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 			// use admin user basic auth if enabled but ignore when BasicAuthChecker defined
 			if a.BasicAuthChecker == nil && a.basicAdminUser(r) {
 				r = token.SetUserInfo(r, adminUser)
+				r = token.SetClaims(r, basicAuthClaims(adminUser))
 				h.ServeHTTP(w, r)
 				return
 			}
@@ -99,13 +109,17 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 						return
 					}
 					r = token.SetUserInfo(r, userInfo) // pass user claims into context of incoming request
+					r = token.SetClaims(r, basicAuthClaims(userInfo))
 					h.ServeHTTP(w, r)
 					return
 				}
 			}
 
 			claims, tkn, err := a.JWTService.Get(r)
-			if err != nil {
+			if err != nil && !(a.SilentRefresh && err == token.NeedToRegenerateTokenError) {
+				if errors.Is(err, token.RevokedTokenError) {
+					a.JWTService.Reset(w) // drop revoked token cookie
+				}
 				onError(h, w, r, fmt.Errorf("can't get token: %w", err))
 				return
 			}
@@ -120,6 +134,11 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 				return
 			}
 
+			if claims.MFARequired { // first factor only, exchanged to the full token by `/mfa/verify`
+				onError(h, w, r, fmt.Errorf("second factor of %s not verified", claims.User.ID))
+				return
+			}
+
 			if claims.User != nil { // if uinfo in token populate it to context
 				// validator passed by client and performs check on token or/and claims
 				if a.Validator != nil && !a.Validator.Validate(tkn, claims) {
@@ -128,7 +147,19 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 					return
 				}
 
+				if a.SessionStore != nil {
+					if err = a.touchSession(r, claims); err != nil {
+						a.JWTService.Reset(w)
+						onError(h, w, r, err)
+						return
+					}
+				}
+
 				if a.JWTService.IsExpired(claims) {
+					if !a.SilentRefresh {
+						onError(h, w, r, fmt.Errorf("token expired"))
+						return
+					}
 					if claims, err = a.refreshExpiredToken(w, claims, tkn); err != nil {
 						a.JWTService.Reset(w)
 						onError(h, w, r, fmt.Errorf("can't refresh token: %w", err))
@@ -137,6 +168,10 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 				}
 
 				r = token.SetUserInfo(r, *claims.User) // populate user info to request context
+				r = token.SetClaims(r, claims)         // and full verified claims
+				if len(claims.Extra) > 0 {
+					r = token.SetExtraInfo(r, claims.Extra) // application-defined claims
+				}
 			}
 
 			h.ServeHTTP(w, r)
@@ -146,6 +181,38 @@ func (a *Authenticator) auth(reqAuth bool) func(http.Handler) http.Handler {
 	return f
 }
 
+// basicAuthClaims makes claims for user authenticated with basic auth, issued now. Auth time left unset,
+// credentials sent with each request are not an interactive login, so RequireRecentAuth rejects them.
+func basicAuthClaims(user token.User) token.Claims {
+	return token.Claims{User: &user, StandardClaims: jwt.StandardClaims{Subject: user.ID, IssuedAt: time.Now().Unix()},
+		AMR: []string{token.AMRBasic}}
+}
+
+// bearerChallenge makes WWW-Authenticate header value for failed auth, RFC 6750.
+// Error code omitted if request had no token at all.
+func bearerChallenge(err error) string {
+	if errors.Is(err, token.NoTokenError) {
+		return "Bearer"
+	}
+	return `Bearer error="invalid_token"`
+}
+
+// touchSession updates session's last-seen time, ip and user agent. Rejects tokens of revoked or unknown session.
+func (a *Authenticator) touchSession(r *http.Request, claims token.Claims) error {
+	if err := token.CheckSession(a.SessionStore, claims.Id, claims.IssuedAt); err != nil {
+		return err
+	}
+	ip, _ := realip.Get(r)
+	s, err := a.SessionStore.Touch(token.Session{ID: claims.Id, UserID: claims.User.ID, IP: ip, UserAgent: r.UserAgent()})
+	if err != nil {
+		return fmt.Errorf("can't update session: %w", err)
+	}
+	if s.Revoked {
+		return token.SessionRevokedError
+	}
+	return nil
+}
+
 // refreshExpiredToken makes a new token with passed claims
 func (a *Authenticator) refreshExpiredToken(w http.ResponseWriter, claims token.Claims, tkn string) (token.Claims, error) {
 
@@ -174,20 +241,7 @@ func (a *Authenticator) refreshExpiredToken(w http.ResponseWriter, claims token.
 // AdminOnly middleware allows access for admins only
 // this handler internally wrapped with auth(true) to avoid situation if AdminOnly defined without prior Auth
 func (a *Authenticator) AdminOnly(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		user, err := token.GetUserInfo(r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		if !user.IsAdmin() {
-			http.Error(w, "Access denied", http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-	return a.auth(true)(http.HandlerFunc(fn)) // enforce auth
+	return a.authorize("admin", IsAdmin())(next)
 }
 
 // basic auth for admin user
@@ -211,26 +265,80 @@ func (a *Authenticator) basicAdminUser(r *http.Request) bool {
 	return true
 }
 
-// RBAC middleware allows role based control for routes
+// RBAC middleware allows role based control for routes, any of user's roles (direct or inherited via Roles) matched
 // this handler internally wrapped with auth(true) to avoid situation if RBAC defined without prior Auth
 func (a *Authenticator) RBAC(roles ...string) func(http.Handler) http.Handler {
+	return a.authorize("rbac", HasRole(roles...))
+}
 
+// RequireRecentAuth middleware allows access for users authenticated not earlier than maxAge ago, with any of methods
+// if passed. Refreshed tokens keep time of the original login, so the user has to login again. Rejected requests get
+// 401 with `WWW-Authenticate: Bearer error="insufficient_user_authentication", max_age=N` hint, RFC 9470.
+// this handler internally wrapped with auth(true) to avoid situation if RequireRecentAuth defined without prior Auth
+func (a *Authenticator) RequireRecentAuth(maxAge time.Duration, methods ...string) func(http.Handler) http.Handler {
 	f := func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			user, err := token.GetUserInfo(r)
+			claims, err := token.GetClaims(r)
 			if err != nil {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			var matched bool
-			for _, role := range roles {
-				if strings.EqualFold(role, user.Role) {
-					matched = true
+			desc := ""
+			switch {
+			case claims.AuthTime == 0 || time.Since(time.Unix(claims.AuthTime, 0)) > maxAge:
+				desc = "authentication too old"
+			case len(methods) > 0 && !claims.HasAMR(methods...):
+				desc = "authentication method not allowed"
+			}
+			if desc != "" {
+				a.Logf("[DEBUG] re-authentication required for %s, %s, amr %v", claims.User.ID, desc, claims.AMR)
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer error="insufficient_user_authentication", error_description=%q, max_age=%d`,
+					desc, int64(maxAge.Seconds())))
+				http.Error(w, "Re-authentication required", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return a.auth(true)(http.HandlerFunc(fn)) // enforce auth
+	}
+	return f
+}
+
+// RequireScopes middleware allows access for tokens with all passed scopes granted
+// this handler internally wrapped with auth(true) to avoid situation if RequireScopes defined without prior Auth
+func (a *Authenticator) RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return a.scopes(true, scopes)
+}
+
+// RequireAnyScope middleware allows access for tokens with any of passed scopes granted
+// this handler internally wrapped with auth(true) to avoid situation if RequireAnyScope defined without prior Auth
+func (a *Authenticator) RequireAnyScope(scopes ...string) func(http.Handler) http.Handler {
+	return a.scopes(false, scopes)
+}
+
+// scopes implements RequireScopes (all=true) and RequireAnyScope (all=false)
+func (a *Authenticator) scopes(all bool, scopes []string) func(http.Handler) http.Handler {
+	f := func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			claims, err := token.GetClaims(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			matched := all
+			for _, s := range scopes {
+				if claims.HasScope(s) != all {
+					matched = !all
 					break
 				}
 			}
 			if !matched {
+				a.Logf("[DEBUG] scopes %v required, granted %q", scopes, claims.Scope)
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " ")))
 				http.Error(w, "Access denied", http.StatusForbidden)
 				return
 			}
@@ -240,3 +348,9 @@ func (a *Authenticator) RBAC(roles ...string) func(http.Handler) http.Handler {
 	}
 	return f
 }
+
+// RequirePermission middleware allows access for users with all passed permissions granted to their roles by Roles
+// this handler internally wrapped with auth(true) to avoid situation if RequirePermission defined without prior Auth
+func (a *Authenticator) RequirePermission(perms ...string) func(http.Handler) http.Handler {
+	return a.authorize("permission", HasPermission(perms...))
+}
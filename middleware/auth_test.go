@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -31,6 +32,7 @@ var testJwtWithRole = "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJhdWQiOiJ0ZXN0X3N5
 
 func TestAuthJWTCookie(t *testing.T) {
 	a := makeTestAuth(t)
+	a.SilentRefresh = true
 
 	mux := http.NewServeMux()
 	handler := func(w http.ResponseWriter, r *http.Request) {
@@ -102,8 +104,106 @@ func TestAuthJWTHeader(t *testing.T) {
 	assert.Equal(t, 401, resp.StatusCode, "token expired")
 }
 
+func TestAuthJWTBearer(t *testing.T) {
+	a := makeTestAuth(t)
+	server := httptest.NewServer(makeTestMux(t, &a, true))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+	require.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+testJwtValid)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode, "valid token user")
+	assert.Equal(t, "", resp.Header.Get("WWW-Authenticate"))
+
+	req, err = http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+	require.Nil(t, err)
+	req.Header.Add("Authorization", "Bearer "+testJwtExpired)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "token expired")
+	assert.Equal(t, `Bearer error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+
+	resp, err = client.Get(server.URL + "/auth")
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "no token")
+	assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestAuthJWTExtra(t *testing.T) {
+	type appClaims struct {
+		TenantID string `json:"tenant_id"`
+	}
+	a := makeTestAuth(t)
+	claims := token.Claims{User: &token.User{ID: "id1", Name: "name1"},
+		StandardClaims: jwt.StandardClaims{Id: "id", ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	require.NoError(t, claims.SetExtra(appClaims{TenantID: "t1"}))
+	tkn, err := a.JWTService.(*token.Service).Token(claims)
+	require.NoError(t, err)
+
+	var extra appClaims
+	var extraErr error
+	h := a.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extraErr = token.GetExtraInfo(r, &extra)
+	}))
+
+	req := httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.Header.Add("X-JWT", tkn)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, extraErr)
+	assert.Equal(t, appClaims{TenantID: "t1"}, extra)
+
+	req = httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.Header.Add("X-JWT", testJwtValid)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, token.NoExtraError, extraErr)
+}
+
+func TestAuthClaimsInContext(t *testing.T) {
+	a := makeTestAuth(t)
+	var claims token.Claims
+	var claimsErr error
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, claimsErr = token.GetClaims(r)
+	})
+
+	for name, h := range map[string]http.Handler{"auth": a.Auth(handler), "trace": a.Trace(handler),
+		"admin": a.AdminOnly(handler), "rbac": a.RBAC("employee")(handler)} {
+		claims, claimsErr = token.Claims{}, nil
+		req := httptest.NewRequest("GET", "/auth", http.NoBody)
+		req.Header.Add("X-JWT", testJwtWithRole)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if name == "admin" {
+			assert.Nil(t, claims.User, "not admin, handler not called")
+			continue
+		}
+		require.NoError(t, claimsErr, name)
+		assert.Equal(t, "random id", claims.Id, name)
+		assert.Equal(t, "test_sys", claims.Audience, name)
+		assert.Equal(t, "remark42", claims.Issuer, name)
+		assert.Equal(t, int64(2789191822), claims.ExpiresAt, name)
+		assert.Equal(t, "id1", claims.User.ID, name)
+	}
+
+	// synthesized for basic auth
+	req := httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.SetBasicAuth("admin", "123456")
+	a.AdminOnly(handler).ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, claimsErr)
+	assert.Equal(t, "admin", claims.Subject)
+	assert.True(t, claims.User.IsAdmin())
+	assert.InDelta(t, time.Now().Unix(), claims.IssuedAt, 5)
+
+	// no token, trace passes without claims
+	a.Trace(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth", http.NoBody))
+	assert.Error(t, claimsErr)
+}
+
 func TestAuthJWTRefresh(t *testing.T) {
 	a := makeTestAuth(t)
+	a.SilentRefresh = true
 	server := httptest.NewServer(makeTestMux(t, &a, true))
 	defer server.Close()
 
@@ -134,9 +234,28 @@ func TestAuthJWTRefresh(t *testing.T) {
 	log.Print(time.Unix(claims.ExpiresAt, 0))
 }
 
+func TestAuthJWTRefreshDisabled(t *testing.T) {
+	a := makeTestAuth(t)
+	server := httptest.NewServer(makeTestMux(t, &a, true))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+	require.NoError(t, err)
+	expiration := int(365 * 24 * time.Hour.Seconds()) // nolint
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: testJwtExpired, HttpOnly: true, Path: "/", MaxAge: expiration, Secure: false})
+	req.Header.Add("X-XSRF-TOKEN", "random id")
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "expired token not refreshed without SilentRefresh")
+	assert.Equal(t, 0, len(resp.Cookies()))
+}
+
 func TestAuthJWTRefreshConcurrentWithCache(t *testing.T) {
 
 	a := makeTestAuth(t)
+	a.SilentRefresh = true
 	server := httptest.NewServer(makeTestMux(t, &a, true))
 	defer server.Close()
 
@@ -212,6 +331,7 @@ func (b *badJwtService) Set(w http.ResponseWriter, claims token.Claims) (token.C
 func TestAuthJWTRefreshFailed(t *testing.T) {
 
 	a := makeTestAuth(t)
+	a.SilentRefresh = true
 	server := httptest.NewServer(makeTestMux(t, &a, true))
 	defer server.Close()
 
@@ -256,6 +376,69 @@ func TestAuthJWtBlocked(t *testing.T) {
 	assert.Equal(t, 401, resp.StatusCode, "blocked user")
 }
 
+func TestAuthJWTRevoked(t *testing.T) {
+	a := makeTestAuth(t)
+	store := token.NewMemRevocationStore()
+	a.JWTService.(*token.Service).RevocationStore = store
+	server := httptest.NewServer(makeTestMux(t, &a, true))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+	require.Nil(t, err)
+	req.Header.Add("X-JWT", testJwtValid)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode, "valid token")
+
+	require.NoError(t, store.Revoke("random id", time.Now().Add(time.Hour)))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "revoked token")
+	require.Equal(t, 6, len(resp.Cookies()), "cookies reset") // jwt, xsrf and 4 jwt chunks
+	assert.Equal(t, "JWT", resp.Cookies()[0].Name)
+	assert.Equal(t, -1, resp.Cookies()[0].MaxAge)
+}
+
+func TestAuthJWTSessionRevoked(t *testing.T) {
+	a := makeTestAuth(t)
+	store := token.NewMemSessionStore(time.Hour)
+	a.SessionStore = store
+	server := httptest.NewServer(makeTestMux(t, &a, true))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", server.URL+"/auth", http.NoBody)
+	require.Nil(t, err)
+	req.Header.Add("X-JWT", testJwtValid)
+	req.Header.Add("User-Agent", "test-agent")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode, "valid token")
+
+	sess, err := store.Get("random id")
+	require.NoError(t, err)
+	assert.Equal(t, "id1", sess.UserID)
+	assert.Equal(t, "127.0.0.1", sess.IP)
+	assert.Equal(t, "test-agent", sess.UserAgent)
+
+	require.NoError(t, store.Revoke("random id"))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "session revoked")
+
+	tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &token.User{ID: "id1", Name: "name1"},
+		StandardClaims: jwt.StandardClaims{Id: "dropped id", Audience: "test_sys", Issuer: "remark42",
+			IssuedAt: time.Now().Add(-time.Hour).Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	req.Header.Set("X-JWT", tkn)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 401, resp.StatusCode, "session unknown for token issued long ago")
+	_, err = store.Get("dropped id")
+	assert.Error(t, err, "unknown session not recreated")
+}
+
 func TestAuthJWtWithHandshake(t *testing.T) {
 	a := makeTestAuth(t)
 	server := httptest.NewServer(makeTestMux(t, &a, true))
@@ -466,6 +649,147 @@ func TestRBAC(t *testing.T) {
 	assert.Equal(t, "Access denied\n", string(data))
 }
 
+func TestRequireScopes(t *testing.T) {
+	a := makeTestAuth(t)
+	claims := token.Claims{User: &token.User{ID: "id1", Name: "name1"},
+		StandardClaims: jwt.StandardClaims{Id: "id", ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	claims.AddScopes("comments:read", "comments:write")
+	tkn, err := a.JWTService.(*token.Service).Token(claims)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	tbl := []struct {
+		name string
+		mw   func(http.Handler) http.Handler
+		code int
+	}{
+		{"all granted", a.RequireScopes("comments:read", "comments:write"), 201},
+		{"one missing", a.RequireScopes("comments:write", "admin"), 403},
+		{"any granted", a.RequireAnyScope("admin", "comments:write"), 201},
+		{"none granted", a.RequireAnyScope("admin", "users:write"), 403},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/auth", http.NoBody)
+			req.Header.Add("Authorization", "Bearer "+tkn)
+			tt.mw(handler).ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code == 403 {
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	a.RequireScopes("comments:read")(handler).ServeHTTP(rr, httptest.NewRequest("GET", "/auth", http.NoBody))
+	assert.Equal(t, 401, rr.Code, "no token")
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	a := makeTestAuth(t)
+	a.SilentRefresh = true
+	makeToken := func(authAge time.Duration, amr ...string) string {
+		claims := token.Claims{User: &token.User{ID: "id1", Name: "name1"},
+			StandardClaims: jwt.StandardClaims{Id: "id", ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+		if authAge > 0 {
+			claims.AuthTime, claims.AMR = time.Now().Add(-authAge).Unix(), amr
+		}
+		tkn, err := a.JWTService.(*token.Service).Token(claims)
+		require.NoError(t, err)
+		return tkn
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+
+	tbl := []struct {
+		name string
+		tkn  string
+		mw   func(http.Handler) http.Handler
+		code int
+	}{
+		{"recent", makeToken(time.Minute, "password"), a.RequireRecentAuth(5 * time.Minute), 201},
+		{"too old", makeToken(10*time.Minute, "password"), a.RequireRecentAuth(5 * time.Minute), 401},
+		{"no auth_time", makeToken(0), a.RequireRecentAuth(time.Hour), 401},
+		{"method allowed", makeToken(time.Minute, "password", "otp"), a.RequireRecentAuth(time.Hour, "otp", "webauthn"), 201},
+		{"method not allowed", makeToken(time.Minute, "oauth/github"), a.RequireRecentAuth(time.Hour, "password"), 401},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/auth", http.NoBody)
+			req.Header.Add("Authorization", "Bearer "+tt.tkn)
+			tt.mw(handler).ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code == 401 {
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+			}
+		})
+	}
+
+	// silent refresh keeps time of authentication
+	claims := token.Claims{User: &token.User{ID: "id1", Name: "name1"}, StandardClaims: jwt.StandardClaims{Id: "id",
+		ExpiresAt: time.Now().Add(-time.Minute).Unix()}}
+	claims.SetAuth("password")
+	claims.AuthTime = time.Now().Add(-time.Hour).Unix()
+	tkn, err := a.JWTService.(*token.Service).Token(claims)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "JWT", Value: tkn})
+	req.Header.Add("X-XSRF-TOKEN", "id")
+	a.RequireRecentAuth(10*time.Minute)(handler).ServeHTTP(rr, req)
+	assert.Equal(t, 401, rr.Code)
+	require.NotEmpty(t, rr.Result().Cookies(), "token refreshed")
+	refreshed, err := a.JWTService.Parse(rr.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, claims.AuthTime, refreshed.AuthTime)
+	assert.Equal(t, []string{"password"}, refreshed.AMR)
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/auth", http.NoBody)
+	req.SetBasicAuth("admin", "123456")
+	a.RequireRecentAuth(time.Minute, token.AMRBasic)(handler).ServeHTTP(rr, req)
+	assert.Equal(t, 401, rr.Code, "basic auth has no auth time, never recent")
+}
+
+func TestRBACHierarchyAndPermissions(t *testing.T) {
+	a := makeTestAuth(t)
+	a.Roles = &token.RoleTable{
+		Inherits:    map[string][]string{"admin": {"moderator"}, "moderator": {"user"}},
+		Permissions: map[string][]string{"user": {"comments:read"}, "moderator": {"comments:delete"}},
+	}
+	makeToken := func(u token.User) string {
+		tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &u,
+			StandardClaims: jwt.StandardClaims{Id: "id", ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+		require.NoError(t, err)
+		return tkn
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+
+	tbl := []struct {
+		name string
+		user token.User
+		mw   func(http.Handler) http.Handler
+		code int
+	}{
+		{"inherited role", token.User{ID: "u1", Role: "admin"}, a.RBAC("user"), 201},
+		{"one of roles", token.User{ID: "u1", Role: "guest", Roles: []string{"moderator"}}, a.RBAC("moderator"), 201},
+		{"role not inherited", token.User{ID: "u1", Role: "user"}, a.RBAC("moderator"), 403},
+		{"direct permission", token.User{ID: "u1", Role: "moderator"}, a.RequirePermission("comments:delete"), 201},
+		{"inherited permission", token.User{ID: "u1", Role: "admin"}, a.RequirePermission("comments:read", "comments:delete"), 201},
+		{"no permission", token.User{ID: "u1", Roles: []string{"user"}}, a.RequirePermission("comments:delete"), 403},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/auth", http.NoBody)
+			req.Header.Add("X-JWT", makeToken(tt.user))
+			tt.mw(handler).ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+		})
+	}
+}
+
 func makeTestMux(_ *testing.T, a *Authenticator, required bool) http.Handler {
 	mux := http.NewServeMux()
 	authMiddleware := a.Auth
@@ -0,0 +1,462 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/efureev/sauth/token"
+)
+
+// Policy decides if the request of authenticated user allowed
+type Policy interface {
+	Allow(req PolicyRequest) bool
+}
+
+// PolicyFunc type is an adapter to allow the use of ordinary functions as Policy.
+type PolicyFunc func(req PolicyRequest) bool
+
+// Allow calls f(req)
+func (f PolicyFunc) Allow(req PolicyRequest) bool {
+	return f(req)
+}
+
+// PolicyRequest is an input of Policy
+type PolicyRequest struct {
+	User    token.User
+	Claims  token.Claims
+	Roles   *token.RoleTable // Authenticator.Roles, nil if not defined
+	Request *http.Request
+}
+
+// PolicyRule binds policy to requests with given method and path, used by Authenticator.Policies
+type PolicyRule struct {
+	Name   string // rule name for decision log, Path used if empty
+	Method string // http method, any if empty
+	Path   string // exact path, or path prefix if ends with "*", "/x/*" matches "/x" as well
+	Policy Policy
+}
+
+// PolicyDecision is a record of decision log
+type PolicyDecision struct {
+	Rule    string
+	UserID  string
+	Method  string
+	Path    string
+	Allowed bool
+}
+
+// DecisionLogger defines interface recording policy decisions
+type DecisionLogger interface {
+	LogDecision(d PolicyDecision)
+}
+
+// DecisionLoggerFunc type is an adapter to allow the use of ordinary functions as DecisionLogger.
+type DecisionLoggerFunc func(d PolicyDecision)
+
+// LogDecision calls f(d)
+func (f DecisionLoggerFunc) LogDecision(d PolicyDecision) {
+	f(d)
+}
+
+// Authorize middleware allows requests passing the policy
+// this handler internally wrapped with auth(true) to avoid situation if Authorize defined without prior Auth
+func (a *Authenticator) Authorize(p Policy) func(http.Handler) http.Handler {
+	return a.authorize("authorize", p)
+}
+
+// Policies middleware applies the first rule matching method and path of the request.
+// Requests matching no rule passed as is, rule with "/*" path can be added last to deny them.
+func (a *Authenticator) Policies(rules ...PolicyRule) func(http.Handler) http.Handler {
+	f := func(h http.Handler) http.Handler {
+		protected := make([]http.Handler, len(rules))
+		for i, rule := range rules {
+			name := rule.Name
+			if name == "" {
+				name = rule.Path
+			}
+			protected[i] = a.authorize(name, rule.Policy)(h)
+		}
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for i, rule := range rules {
+				if rule.match(r) {
+					protected[i].ServeHTTP(w, r)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+	return f
+}
+
+// authorize checks the policy for authenticated user and records decision
+func (a *Authenticator) authorize(name string, p Policy) func(http.Handler) http.Handler {
+	f := func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user, err := token.GetUserInfo(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			claims, _ := token.GetClaims(r)
+
+			allowed := p.Allow(PolicyRequest{User: user, Claims: claims, Roles: a.Roles, Request: r})
+			a.logDecision(PolicyDecision{Rule: name, UserID: user.ID, Method: r.Method, Path: r.URL.Path, Allowed: allowed})
+			if !allowed {
+				http.Error(w, "Access denied", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+		return a.auth(true)(http.HandlerFunc(fn)) // enforce auth
+	}
+	return f
+}
+
+func (a *Authenticator) logDecision(d PolicyDecision) {
+	if a.DecisionLog != nil {
+		a.DecisionLog.LogDecision(d)
+		return
+	}
+	if !d.Allowed {
+		a.Logf("[DEBUG] policy %s denied %s %s for %s", d.Rule, d.Method, d.Path, d.UserID)
+	}
+}
+
+func (p PolicyRule) match(r *http.Request) bool {
+	if p.Method != "" && !strings.EqualFold(p.Method, r.Method) {
+		return false
+	}
+	// cleaned to prevent bypass with paths like /x/../admin or //admin, url.Path already unescaped
+	reqPath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(p.Path, "*") {
+		prefix := strings.TrimSuffix(p.Path, "*")
+		if strings.HasSuffix(prefix, "/") && reqPath == strings.TrimSuffix(prefix, "/") {
+			return true // "/x/*" covers "/x" too
+		}
+		return strings.HasPrefix(reqPath, prefix)
+	}
+	return reqPath == path.Clean("/"+p.Path)
+}
+
+// And allows request allowed by all policies
+func And(policies ...Policy) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		for _, p := range policies {
+			if !p.Allow(req) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Or allows request allowed by any of policies
+func Or(policies ...Policy) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		for _, p := range policies {
+			if p.Allow(req) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not allows request denied by the policy
+func Not(p Policy) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool { return !p.Allow(req) })
+}
+
+// IsAdmin allows admin users
+func IsAdmin() Policy {
+	return PolicyFunc(func(req PolicyRequest) bool { return req.User.IsAdmin() })
+}
+
+// IsPaidSub allows paid subscribers
+func IsPaidSub() Policy {
+	return PolicyFunc(func(req PolicyRequest) bool { return req.User.IsPaidSub() })
+}
+
+// HasAttr allows users with true bool attribute
+func HasAttr(key string) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool { return req.User.BoolAttr(key) })
+}
+
+// HasRole allows users with any of roles, direct or inherited via RoleTable
+func HasRole(roles ...string) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		for _, role := range roles {
+			if req.Roles.HasRole(req.User, role) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// HasPermission allows users with all permissions granted to their roles
+func HasPermission(perms ...string) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		for _, perm := range perms {
+			if !req.User.HasPermission(req.Roles, perm) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// HasScope allows tokens with all scopes granted
+func HasScope(scopes ...string) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		for _, s := range scopes {
+			if !req.Claims.HasScope(s) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// IsOwner allows user with id equal to the owner of requested resource
+func IsOwner(owner RequestValue) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		id := owner(req.Request)
+		return id != "" && id == req.User.ID
+	})
+}
+
+// AudienceIs allows tokens with aud equal to the value from request, i.e. tenant in path
+func AudienceIs(aud RequestValue) Policy {
+	return PolicyFunc(func(req PolicyRequest) bool {
+		v := aud(req.Request)
+		return v != "" && v == req.Claims.Audience
+	})
+}
+
+// RequestValue extracts value from request, i.e. owner of resource or tenant
+type RequestValue func(r *http.Request) string
+
+// PathElem returns i-th element of url path, counted from 0, negative index counted from the end
+func PathElem(i int) RequestValue {
+	return func(r *http.Request) string {
+		elems := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		idx := i
+		if idx < 0 {
+			idx += len(elems)
+		}
+		if idx < 0 || idx >= len(elems) {
+			return ""
+		}
+		return elems[idx]
+	}
+}
+
+// QueryParam returns value of url query param
+func QueryParam(name string) RequestValue {
+	return func(r *http.Request) string { return r.URL.Query().Get(name) }
+}
+
+// Header returns value of request header
+func Header(name string) RequestValue {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// ParsePolicy makes Policy from expression with predicates combined by "&&", "||", "!" and parentheses, i.e.
+// `admin || owner:path:1`, `paid && !role:guest`, `aud:header:X-Tenant && (perm:comments:write || scope:comments)`.
+// Predicates: admin, paid, attr:KEY, role:ROLE, perm:PERMISSION, scope:SCOPE, owner:SOURCE and aud:SOURCE
+// with SOURCE of path:INDEX, query:NAME or header:NAME.
+func ParsePolicy(expr string) (Policy, error) {
+	p := policyParser{tokens: tokenizePolicy(expr)}
+	res, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %w", expr, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid policy %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return res, nil
+}
+
+// MustParsePolicy makes Policy from expression and panics on error, for static policies
+func MustParsePolicy(expr string) Policy {
+	p, err := ParsePolicy(expr)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *policyParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *policyParser) or() (Policy, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	res := []Policy{left}
+	for p.next() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, right)
+	}
+	if len(res) == 1 {
+		return left, nil
+	}
+	return Or(res...), nil
+}
+
+func (p *policyParser) and() (Policy, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	res := []Policy{left}
+	for p.next() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, right)
+	}
+	if len(res) == 1 {
+		return left, nil
+	}
+	return And(res...), nil
+}
+
+func (p *policyParser) unary() (Policy, error) {
+	switch tkn := p.next(); tkn {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "!":
+		p.pos++
+		res, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(res), nil
+	case "(":
+		p.pos++
+		res, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return res, nil
+	case ")", "&&", "||":
+		return nil, fmt.Errorf("unexpected %q", tkn)
+	default:
+		p.pos++
+		return predicate(tkn)
+	}
+}
+
+// predicate makes Policy from predicate NAME[:ARG]
+func predicate(tkn string) (Policy, error) {
+	name, arg := tkn, ""
+	if i := strings.Index(tkn, ":"); i >= 0 {
+		name, arg = tkn[:i], tkn[i+1:]
+	}
+
+	noArg := map[string]func() Policy{"admin": IsAdmin, "paid": IsPaidSub}
+	withArg := map[string]func(...string) Policy{"role": HasRole, "perm": HasPermission, "scope": HasScope,
+		"attr": func(keys ...string) Policy { return HasAttr(keys[0]) }}
+
+	if f, ok := noArg[name]; ok {
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected argument of %s", name)
+		}
+		return f(), nil
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("no argument of %s", name)
+	}
+	if f, ok := withArg[name]; ok {
+		return f(arg), nil
+	}
+	if name == "owner" || name == "aud" {
+		val, err := requestValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		if name == "owner" {
+			return IsOwner(val), nil
+		}
+		return AudienceIs(val), nil
+	}
+	return nil, fmt.Errorf("unknown predicate %q", name)
+}
+
+// requestValue makes RequestValue from SOURCE of path:INDEX, query:NAME or header:NAME
+func requestValue(src string) (RequestValue, error) {
+	elems := strings.SplitN(src, ":", 2)
+	if len(elems) != 2 || elems[1] == "" {
+		return nil, fmt.Errorf("invalid source %q", src)
+	}
+	switch elems[0] {
+	case "path":
+		i, err := strconv.Atoi(elems[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid path index %q", elems[1])
+		}
+		return PathElem(i), nil
+	case "query":
+		return QueryParam(elems[1]), nil
+	case "header":
+		return Header(elems[1]), nil
+	}
+	return nil, fmt.Errorf("unknown source %q", elems[0])
+}
+
+// tokenizePolicy splits expression to operators, parentheses and predicates
+func tokenizePolicy(expr string) (res []string) {
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		switch c := rs[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '!':
+			res = append(res, string(c))
+			i++
+		case (c == '&' || c == '|') && i+1 < len(rs) && rs[i+1] == c:
+			res = append(res, string([]rune{c, c}))
+			i += 2
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune("()!&|", rs[j]) {
+				j++
+			}
+			if j == i { // single & or |
+				j++
+			}
+			res = append(res, string(rs[i:j]))
+			i = j
+		}
+	}
+	return res
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/efureev/sauth/token"
+)
+
+func TestParsePolicy(t *testing.T) {
+	roles := &token.RoleTable{Inherits: map[string][]string{"admin": {"moderator"}},
+		Permissions: map[string][]string{"moderator": {"comments:delete"}}}
+	req := httptest.NewRequest("GET", "/t1/users/id1?owner=id2", http.NoBody)
+	req.Header.Set("X-Tenant", "t1")
+	preq := PolicyRequest{
+		User: token.User{ID: "id1", Role: "admin",
+			Attributes: map[string]interface{}{"admin": true, "is_paid_sub": true, "beta": true}},
+		Claims:  token.Claims{StandardClaims: jwt.StandardClaims{Audience: "t1"}, Scope: "read write"},
+		Roles:   roles,
+		Request: req,
+	}
+
+	tbl := []struct {
+		expr    string
+		allowed bool
+	}{
+		{"admin", true},
+		{"paid", true},
+		{"!paid", false},
+		{"attr:beta && attr:gamma", false},
+		{"attr:beta || attr:gamma", true},
+		{"role:moderator", true},
+		{"perm:comments:delete && scope:write", true},
+		{"scope:delete", false},
+		{"owner:path:-1", true},
+		{"owner:query:owner", false},
+		{"aud:path:0 && aud:header:X-Tenant", true},
+		{"aud:path:1", false},
+		{"!(admin && paid) || owner:path:2", true},
+		{"!admin || !paid", false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.expr, func(t *testing.T) {
+			p, err := ParsePolicy(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, p.Allow(preq))
+		})
+	}
+
+	for _, expr := range []string{"", "admin &&", "(admin", "admin)", "admin:x", "role", "foo", "owner:path:x",
+		"aud:cookie:x", "admin & paid"} {
+		_, err := ParsePolicy(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	a := makeTestAuth(t)
+	var decisions []PolicyDecision
+	a.DecisionLog = DecisionLoggerFunc(func(d PolicyDecision) { decisions = append(decisions, d) })
+	makeToken := func(u token.User, aud string) string {
+		tkn, err := a.JWTService.(*token.Service).Token(token.Claims{User: &u,
+			StandardClaims: jwt.StandardClaims{Id: "id", Audience: aud, ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+		require.NoError(t, err)
+		return tkn
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) })
+	h := a.Policies(
+		PolicyRule{Name: "owner", Method: "DELETE", Path: "/users/*", Policy: Or(IsAdmin(), IsOwner(PathElem(1)))},
+		PolicyRule{Path: "/tenants/*", Policy: MustParsePolicy("aud:path:1")},
+	)(handler)
+
+	tbl := []struct {
+		method, path string
+		user         token.User
+		aud          string
+		code         int
+	}{
+		{"DELETE", "/users/u1", token.User{ID: "u1"}, "", 201},
+		{"DELETE", "/users/u1", token.User{ID: "u2"}, "", 403},
+		{"DELETE", "/users/u1", token.User{ID: "u2", Attributes: map[string]interface{}{"admin": true}}, "", 201},
+		{"GET", "/users/u1", token.User{ID: "u2"}, "", 201},
+		{"GET", "/tenants/t1/info", token.User{ID: "u1"}, "t1", 201},
+		{"GET", "/tenants/t1/info", token.User{ID: "u1"}, "t2", 403},
+		{"GET", "/tenants", token.User{ID: "u1"}, "t1", 403},
+		{"GET", "/public/../tenants/t1/info", token.User{ID: "u1"}, "t2", 403},
+		{"GET", "/public/%2e%2e/tenants/t1/info", token.User{ID: "u1"}, "t2", 403},
+		{"GET", "/public/info", token.User{ID: "u1"}, "t2", 201},
+	}
+	for _, tt := range tbl {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, http.NoBody)
+		req.Header.Add("X-JWT", makeToken(tt.user, tt.aud))
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, tt.code, rr.Code, "%s %s %+v", tt.method, tt.path, tt.user)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("DELETE", "/users/u1", http.NoBody))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	require.Equal(t, 8, len(decisions), "unmatched and unauthorized requests not logged")
+	assert.Equal(t, PolicyDecision{Rule: "owner", UserID: "u2", Method: "DELETE", Path: "/users/u1", Allowed: false}, decisions[1])
+	assert.Equal(t, PolicyDecision{Rule: "/tenants/*", UserID: "u1", Method: "GET", Path: "/tenants/t1/info", Allowed: true},
+		decisions[3])
+}
+
+func TestPolicyRuleMatch(t *testing.T) {
+	tbl := []struct {
+		rule  PolicyRule
+		path  string
+		match bool
+	}{
+		{PolicyRule{Path: "/admin/*"}, "/admin/users", true},
+		{PolicyRule{Path: "/admin/*"}, "/admin", true},
+		{PolicyRule{Path: "/admin/*"}, "/admin/", true},
+		{PolicyRule{Path: "/admin/*"}, "/administrator", false},
+		{PolicyRule{Path: "/admin/*"}, "/public/../admin/users", true},
+		{PolicyRule{Path: "/admin/*"}, "/public/%2e%2e/admin", true},
+		{PolicyRule{Path: "/admin/*"}, "//admin/users", true},
+		{PolicyRule{Path: "/admin/*"}, "/./admin", true},
+		{PolicyRule{Path: "/admin/*"}, "/public/users", false},
+		{PolicyRule{Path: "/admin"}, "/admin/", true},
+		{PolicyRule{Path: "/admin"}, "/x/../admin", true},
+		{PolicyRule{Path: "/admin"}, "/admin/users", false},
+		{PolicyRule{Path: "/*"}, "/", true},
+		{PolicyRule{Path: "/*"}, "/any/path", true},
+		{PolicyRule{Path: "/admin/*", Method: "POST"}, "/admin", false},
+	}
+	for _, tt := range tbl {
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, http.NoBody)
+		assert.Equal(t, tt.match, tt.rule.match(req), "%+v %s", tt.rule, tt.path)
+	}
+}
+
+func TestPathElem(t *testing.T) {
+	last, second := PathElem(-1), PathElem(1)
+	for i := 0; i < 3; i++ { // negative index reused by each request
+		assert.Equal(t, "c", last(httptest.NewRequest("GET", "/a/b/c", http.NoBody)))
+		assert.Equal(t, "x", last(httptest.NewRequest("GET", "/x", http.NoBody)))
+	}
+	assert.Equal(t, "b", second(httptest.NewRequest("GET", "/a/b/c", http.NoBody)))
+	assert.Equal(t, "", second(httptest.NewRequest("GET", "/a", http.NoBody)))
+	assert.Equal(t, "", PathElem(-5)(httptest.NewRequest("GET", "/a", http.NoBody)))
+}
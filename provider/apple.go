@@ -350,6 +350,11 @@ func (ah AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 	// try parse username if one exist at response or noname assign
 	ah.parseUserData(&u, jUser)
 
+	if u, err = resolveIdentity(w, r, ah.IdentityStore, ah.JwtService, ah.name, u); err != nil {
+		rest.SendErrorJSON(w, r, ah.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	cid, err := randToken()
 	if err != nil {
 		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to make claim's id")
@@ -366,6 +371,13 @@ func (ah AppleHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		SessionOnly: false,
 	}
 
+	claims.SetAuth(token.AMROAuth(ah.name))
+
+	if err = requireSecondFactor(ah.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err = ah.JwtService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, ah.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -0,0 +1,127 @@
+package provider
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// cborMaxDepth limits nesting of decoded items
+const cborMaxDepth = 16
+
+// cborDecode decodes the first CBOR item (RFC 8949) of data and returns it with number of consumed bytes.
+// Only definite-length items used by WebAuthn supported: integers (as int64), byte and text strings,
+// arrays, maps (as map[interface{}]interface{}), booleans and null.
+func cborDecode(data []byte) (v interface{}, n int, err error) {
+	return cborItem(data, 0)
+}
+
+func cborItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, fmt.Errorf("cbor nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("cbor unexpected end")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+
+	if major == 7 { // simple values
+		switch info {
+		case 20:
+			return false, 1, nil
+		case 21:
+			return true, 1, nil
+		case 22:
+			return nil, 1, nil
+		}
+		return nil, 0, fmt.Errorf("cbor simple value %d not supported", info)
+	}
+
+	arg, n, err := cborArg(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, 0, fmt.Errorf("cbor integer overflow")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, 0, fmt.Errorf("cbor integer overflow")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, fmt.Errorf("cbor string out of data")
+		}
+		end := n + int(arg)
+		if major == 3 {
+			return string(data[n:end]), end, nil
+		}
+		return append([]byte{}, data[n:end]...), end, nil
+	case 4:
+		if arg > uint64(len(data)) { // each item takes at least one byte
+			return nil, 0, fmt.Errorf("cbor array out of data")
+		}
+		res := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, l, err := cborItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			res = append(res, item)
+			n += l
+		}
+		return res, n, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, fmt.Errorf("cbor map out of data")
+		}
+		res := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, l, err := cborItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += l
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, fmt.Errorf("cbor map key %T not supported", key)
+			}
+			val, l, err := cborItem(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += l
+			res[key] = val
+		}
+		return res, n, nil
+	}
+	return nil, 0, fmt.Errorf("cbor major type %d not supported", major)
+}
+
+// cborArg reads argument of the item, returns it with length of the head
+func cborArg(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < 1+size {
+			return 0, 0, fmt.Errorf("cbor unexpected end")
+		}
+		switch size {
+		case 1:
+			return uint64(data[1]), 2, nil
+		case 2:
+			return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+		case 4:
+			return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+		}
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, fmt.Errorf("cbor indefinite length not supported")
+}
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConfirmationUsedError returned by ConfirmationStore.Use for the confirmation consumed already
+var ConfirmationUsedError = fmt.Errorf(`confirmation used already`)
+
+// ConfirmationStore keeps state of confirmations sent by VerifyHandler, keyed by id (jti) of confirmation token.
+// It records consumed confirmations and hashes of numeric codes with the number of attempts to enter them.
+type ConfirmationStore interface {
+	// Use marks confirmation consumed till expiration, returns ConfirmationUsedError if it was consumed already
+	Use(id string, expires time.Time) error
+	// PutCode saves hash of the code sent for confirmation
+	PutCode(id, hash string, expires time.Time) error
+	// Attempt counts an attempt to enter the code, returns hash of the code and number of attempts made,
+	// including this one. Empty hash returned for unknown or expired confirmation
+	Attempt(id string) (hash string, attempts int, err error)
+}
+
+// MemConfirmationStore implements ConfirmationStore in memory, thread safe. Expired records dropped on writes.
+type MemConfirmationStore struct {
+	lock  sync.Mutex
+	used  map[string]time.Time
+	codes map[string]*confirmationCode
+}
+
+type confirmationCode struct {
+	hash     string
+	attempts int
+	expires  time.Time
+}
+
+// NewMemConfirmationStore makes in-memory confirmation store
+func NewMemConfirmationStore() *MemConfirmationStore {
+	return &MemConfirmationStore{used: map[string]time.Time{}, codes: map[string]*confirmationCode{}}
+}
+
+// Use marks confirmation consumed
+func (m *MemConfirmationStore) Use(id string, expires time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cleanup()
+	if _, ok := m.used[id]; ok {
+		return ConfirmationUsedError
+	}
+	m.used[id] = expires
+	delete(m.codes, id)
+	return nil
+}
+
+// PutCode saves hash of the code
+func (m *MemConfirmationStore) PutCode(id, hash string, expires time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cleanup()
+	m.codes[id] = &confirmationCode{hash: hash, expires: expires}
+	return nil
+}
+
+// Attempt counts an attempt to enter the code
+func (m *MemConfirmationStore) Attempt(id string) (hash string, attempts int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.codes[id]
+	if !ok || time.Now().After(c.expires) {
+		return "", 0, nil
+	}
+	c.attempts++
+	return c.hash, c.attempts, nil
+}
+
+// cleanup drops expired records, should be called under lock
+func (m *MemConfirmationStore) cleanup() {
+	now := time.Now()
+	for id, exp := range m.used {
+		if now.After(exp) {
+			delete(m.used, id)
+		}
+	}
+	for id, c := range m.codes {
+		if now.After(c.expires) {
+			delete(m.codes, id)
+		}
+	}
+}
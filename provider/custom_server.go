@@ -26,6 +26,7 @@ type CustomHandlerOpt struct {
 	//MapUserFn func(UserRawData, []byte) token.User
 	Scopes         []string
 	InfoUrlMappers []Oauth2Mapper
+	PKCE           bool // use PKCE, go-oauth2/oauth2 server supports it out of the box
 }
 
 // CustomServerOpt are options to initialize a custom go-oauth2/oauth2 server
@@ -204,6 +205,9 @@ func (c *CustomServer) Shutdown() {
 
 // NewCustom creates a handler for go-oauth2/oauth2 server
 func NewCustom(name string, p Params, copts CustomHandlerOpt) Oauth2Handler {
+	if copts.PKCE {
+		p.PKCE = true
+	}
 	return initOauth2Handler(p, Oauth2Handler{
 		name:           name,
 		endpoint:       copts.Endpoint,
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/efureev/sauth/limit"
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	"github.com/efureev/sauth/token"
 	"github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt"
@@ -29,6 +31,11 @@ type DirectHandler struct {
 	Issuer       string
 	AvatarSaver  AvatarSaver
 	UserIDFunc   UserIDFunc
+
+	IdentityStore IdentityStore    // optional store of identities linked to canonical users
+	SecondFactor  mfa.SecondFactor // optional second factor, required for enrolled users after login
+
+	Limits limit.Limits // optional limits of login attempts per ip and user, lockout after failed passwords
 }
 
 // CredChecker defines interface to check credentials
@@ -85,15 +92,27 @@ func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Errorf("no credential checker"), "no credential checker")
 		return
 	}
+
+	userKey := p.ProviderName + ":" + creds.User
+	if !checkLimits(w, r, p.L, p.Limits, userKey, "") || !p.checkLockout(w, r, userKey) {
+		return
+	}
+
 	ok, err := p.CredChecker.Check(creds.User, creds.Password)
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check user credentials")
 		return
 	}
 	if !ok {
+		p.failLockout(userKey)
 		rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "incorrect user or password")
 		return
 	}
+	if p.Limits.Lockout != nil {
+		if err = p.Limits.Lockout.Reset(userKey); err != nil {
+			p.Logf("[WARN] can't reset lockout of %s, %v", userKey, err)
+		}
+	}
 
 	userID := p.ProviderName + "_" + token.HashID(sha1.New(), creds.User)
 	if p.UserIDFunc != nil {
@@ -110,6 +129,11 @@ func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if u, err = resolveIdentity(w, r, p.IdentityStore, p.TokenService, p.ProviderName, u); err != nil {
+		rest.SendErrorJSON(w, r, p.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	cid, err := randToken()
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "can't make token id")
@@ -126,6 +150,13 @@ func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		SessionOnly: sessOnly,
 	}
 
+	claims.SetAuth(token.AMRPassword)
+
+	if err = requireSecondFactor(p.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err = p.TokenService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -133,6 +164,39 @@ func (p DirectHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	rest.RenderJSON(w, claims.User)
 }
 
+// checkLockout rejects login of locked user with 429 and Retry-After, returns false in this case
+func (p DirectHandler) checkLockout(w http.ResponseWriter, r *http.Request, userKey string) bool {
+	if p.Limits.Lockout == nil {
+		return true
+	}
+	wait, err := p.Limits.Lockout.Locked(userKey)
+	if err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check lockout")
+		return false
+	}
+	if wait > 0 {
+		limit.SetRetryAfter(w, wait)
+		rest.SendErrorJSON(w, r, p.L, http.StatusTooManyRequests, fmt.Errorf("user locked"), "too many failed attempts")
+		return false
+	}
+	return true
+}
+
+// failLockout records failed password of the user
+func (p DirectHandler) failLockout(userKey string) {
+	if p.Limits.Lockout == nil {
+		return
+	}
+	wait, err := p.Limits.Lockout.Fail(userKey)
+	if err != nil {
+		p.Logf("[WARN] can't record failed login of %s, %v", userKey, err)
+		return
+	}
+	if wait > 0 {
+		p.Logf("[INFO] %s locked for %v after failed logins", userKey, wait)
+	}
+}
+
 // getCredentials extracts user and password from request
 func (p DirectHandler) getCredentials(w http.ResponseWriter, r *http.Request) (credentials, error) {
 
@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/efureev/sauth/limit"
 	"github.com/efureev/sauth/logger"
 	"github.com/efureev/sauth/token"
 )
@@ -211,6 +212,42 @@ func TestDirect_LoginHandlerFailed(t *testing.T) {
 	}
 }
 
+func TestDirect_LoginHandlerLimits(t *testing.T) {
+	d := DirectHandler{
+		ProviderName: "test",
+		CredChecker:  CredCheckerFunc(func(user, pass string) (ok bool, err error) { return pass == "good", nil }),
+		TokenService: token.NewService(token.Opts{
+			SecretReader:  token.SecretFunc(func(string) (string, error) { return "secret", nil }),
+			TokenDuration: time.Hour,
+		}),
+		L: logger.Std,
+		Limits: limit.Limits{
+			User:    limit.NewMemLimiter(5, time.Minute),
+			Lockout: limit.NewMemLockout(2, time.Minute, time.Hour),
+		},
+	}
+	login := func(user, passwd string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		d.LoginHandler(rr, httptest.NewRequest("GET", "/login?user="+user+"&passwd="+passwd, http.NoBody))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, login("u1", "bad").Code)
+	assert.Equal(t, http.StatusOK, login("u1", "good").Code, "success resets failures")
+	assert.Equal(t, http.StatusForbidden, login("u1", "bad").Code)
+	assert.Equal(t, http.StatusForbidden, login("u1", "bad").Code, "locked by this failure")
+	rr := login("u1", "good")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "locked")
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, login("u2", "good").Code, "other user not locked")
+
+	for i := 0; i < 5; i++ { // one token of user's bucket taken already
+		rr = login("u2", "good")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "user limit")
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
 func TestDirect_Logout(t *testing.T) {
 	d := DirectHandler{
 		ProviderName: "test",
@@ -230,7 +267,7 @@ func TestDirect_Logout(t *testing.T) {
 	require.NoError(t, err)
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, 200, rr.Code)
-	assert.Equal(t, 2, len(rr.Header()["Set-Cookie"]))
+	assert.Equal(t, 6, len(rr.Header()["Set-Cookie"])) // jwt, xsrf and 4 jwt chunks
 
 	request := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
 	c, err := request.Cookie("JWT")
@@ -0,0 +1,153 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/efureev/sauth/token"
+)
+
+// LinkCookieName is a name of the cookie with link token, set by `/{provider}/link` of auth handler.
+// Presence of valid link token on login makes provider to link its user to the user of the token.
+const LinkCookieName = "JWT-LINK"
+
+// IdentityLinkedError returned by IdentityStore.Link for identity linked to another user already
+var IdentityLinkedError = fmt.Errorf(`identity linked to another user`)
+
+// Identity is a user of the provider linked to canonical user
+type Identity struct {
+	UserID     string    `json:"user_id"`     // canonical user id
+	Provider   string    `json:"provider"`    // provider name
+	ProviderID string    `json:"provider_id"` // user id made by provider
+	LinkedAt   time.Time `json:"linked_at"`
+}
+
+// IdentityStore defines interface mapping users of providers to canonical users
+type IdentityStore interface {
+	// Resolve returns canonical user id for user id made by provider, empty string if not linked
+	Resolve(provider, providerID string) (string, error)
+	// Link adds identity to the user, fails with IdentityLinkedError if linked to another user
+	Link(id Identity) error
+	// Unlink removes identities of the provider from the user
+	Unlink(userID, provider string) error
+	// List returns identities linked to the user
+	List(userID string) ([]Identity, error)
+}
+
+// claimsParser defines minimal interface to parse link token, implemented by TokenService and VerifTokenService
+type claimsParser interface {
+	Parse(tokenString string) (claims token.Claims, err error)
+}
+
+// resolveIdentity applied by providers before issuing the token. If link token presented, links user
+// of the provider to the user of the link token and returns the latter. Otherwise replaces id of the user
+// with canonical id if user linked.
+func resolveIdentity(w http.ResponseWriter, r *http.Request, store IdentityStore, tp claimsParser,
+	provider string, u token.User) (token.User, error) {
+	if store == nil {
+		return u, nil
+	}
+
+	if c, err := r.Cookie(LinkCookieName); err == nil && c.Value != "" {
+		http.SetCookie(w, &http.Cookie{Name: LinkCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		linkClaims, err := tp.Parse(c.Value)
+		if err != nil {
+			return u, fmt.Errorf("invalid link token: %w", err)
+		}
+		if linkClaims.User == nil || linkClaims.Handshake == nil {
+			return u, fmt.Errorf("invalid link token: no user or handshake")
+		}
+		if linkClaims.Handshake.ID != "link" {
+			return u, fmt.Errorf("invalid link token: not a link handshake")
+		}
+		if !linkClaims.VerifyExpiresAt(time.Now().Unix(), true) { // Parse allows expired tokens
+			return u, fmt.Errorf("invalid link token: expired")
+		}
+		current := *linkClaims.User
+		if current.ID == u.ID {
+			return current, nil
+		}
+		err = store.Link(Identity{UserID: current.ID, Provider: provider, ProviderID: u.ID, LinkedAt: time.Now()})
+		if err != nil {
+			return u, fmt.Errorf("can't link %s to %s: %w", u.ID, current.ID, err)
+		}
+		return current, nil
+	}
+
+	id, err := store.Resolve(provider, u.ID)
+	if err != nil {
+		return u, fmt.Errorf("can't resolve identity %s: %w", u.ID, err)
+	}
+	if id != "" {
+		u.ID = id
+	}
+	return u, nil
+}
+
+// identityErrorCode returns http status for resolveIdentity error
+func identityErrorCode(err error) int {
+	if errors.Is(err, IdentityLinkedError) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// MemIdentityStore implements IdentityStore in memory, thread safe
+type MemIdentityStore struct {
+	lock       sync.Mutex
+	identities map[string]Identity // key is provider/provider id
+}
+
+// NewMemIdentityStore makes in-memory identity store
+func NewMemIdentityStore() *MemIdentityStore {
+	return &MemIdentityStore{identities: map[string]Identity{}}
+}
+
+// Resolve returns canonical user id
+func (m *MemIdentityStore) Resolve(provider, providerID string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.identities[provider+"/"+providerID].UserID, nil
+}
+
+// Link adds identity
+func (m *MemIdentityStore) Link(id Identity) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := id.Provider + "/" + id.ProviderID
+	if existing, ok := m.identities[key]; ok && existing.UserID != id.UserID {
+		return IdentityLinkedError
+	}
+	m.identities[key] = id
+	return nil
+}
+
+// Unlink removes identities of the provider
+func (m *MemIdentityStore) Unlink(userID, provider string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, id := range m.identities {
+		if id.UserID == userID && id.Provider == provider {
+			delete(m.identities, key)
+		}
+	}
+	return nil
+}
+
+// List returns identities of the user, oldest first
+func (m *MemIdentityStore) List(userID string) ([]Identity, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []Identity{}
+	for _, id := range m.identities {
+		if id.UserID == userID {
+			res = append(res, id)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LinkedAt.Before(res[j].LinkedAt) })
+	return res, nil
+}
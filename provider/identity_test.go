@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/efureev/sauth/token"
+)
+
+func TestMemIdentityStore(t *testing.T) {
+	s := NewMemIdentityStore()
+	id, err := s.Resolve("github", "github_1")
+	require.NoError(t, err)
+	assert.Equal(t, "", id, "not linked")
+
+	require.NoError(t, s.Link(Identity{UserID: "google_1", Provider: "github", ProviderID: "github_1", LinkedAt: time.Now()}))
+	require.NoError(t, s.Link(Identity{UserID: "google_1", Provider: "twitter", ProviderID: "twitter_1",
+		LinkedAt: time.Now().Add(time.Second)}))
+	require.NoError(t, s.Link(Identity{UserID: "google_1", Provider: "github", ProviderID: "github_1"}), "relink")
+	assert.Equal(t, IdentityLinkedError, s.Link(Identity{UserID: "google_2", Provider: "github", ProviderID: "github_1"}))
+
+	id, err = s.Resolve("github", "github_1")
+	require.NoError(t, err)
+	assert.Equal(t, "google_1", id)
+
+	ids, err := s.List("google_1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(ids))
+	assert.Equal(t, "twitter_1", ids[1].ProviderID)
+
+	require.NoError(t, s.Unlink("google_1", "github"))
+	id, err = s.Resolve("github", "github_1")
+	require.NoError(t, err)
+	assert.Equal(t, "", id)
+	ids, err = s.List("google_1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(ids))
+}
+
+func TestResolveIdentity(t *testing.T) {
+	jwtService := token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour})
+	store := NewMemIdentityStore()
+	u := token.User{ID: "github_1", Name: "user"}
+
+	res, err := resolveIdentity(httptest.NewRecorder(), httptest.NewRequest("GET", "/", http.NoBody), nil, jwtService, "github", u)
+	require.NoError(t, err)
+	assert.Equal(t, u, res, "no store, no changes")
+
+	// not a link token
+	tkn, err := jwtService.Token(token.Claims{User: &token.User{ID: "google_1"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: LinkCookieName, Value: tkn})
+	_, err = resolveIdentity(httptest.NewRecorder(), req, store, jwtService, "github", u)
+	assert.EqualError(t, err, "invalid link token: no user or handshake")
+
+	// handshake of another kind, i.e. oauth2 login
+	tkn, err = jwtService.Token(token.Claims{User: &token.User{ID: "google_1"}, Handshake: &token.Handshake{State: "state"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	req = httptest.NewRequest("GET", "/", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: LinkCookieName, Value: tkn})
+	_, err = resolveIdentity(httptest.NewRecorder(), req, store, jwtService, "github", u)
+	assert.EqualError(t, err, "invalid link token: not a link handshake")
+
+	// expired link token
+	tkn, err = jwtService.Token(token.Claims{User: &token.User{ID: "google_1"}, Handshake: &token.Handshake{ID: "link"},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}})
+	require.NoError(t, err)
+	req = httptest.NewRequest("GET", "/", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: LinkCookieName, Value: tkn})
+	_, err = resolveIdentity(httptest.NewRecorder(), req, store, jwtService, "github", u)
+	assert.EqualError(t, err, "invalid link token: expired")
+	ids, err := store.List("google_1")
+	require.NoError(t, err)
+	assert.Empty(t, ids, "nothing linked by rejected tokens")
+
+	tkn, err = jwtService.Token(token.Claims{User: &token.User{ID: "google_1", Name: "google user"},
+		Handshake: &token.Handshake{ID: "link"}, StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	req = httptest.NewRequest("GET", "/", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: LinkCookieName, Value: tkn})
+	rr := httptest.NewRecorder()
+	res, err = resolveIdentity(rr, req, store, jwtService, "github", u)
+	require.NoError(t, err)
+	assert.Equal(t, token.User{ID: "google_1", Name: "google user"}, res)
+	assert.Equal(t, -1, rr.Result().Cookies()[0].MaxAge, "link cookie removed")
+
+	res, err = resolveIdentity(httptest.NewRecorder(), httptest.NewRequest("GET", "/", http.NoBody), store, jwtService, "github", u)
+	require.NoError(t, err)
+	assert.Equal(t, token.User{ID: "google_1", Name: "user"}, res, "resolved to canonical id")
+}
@@ -0,0 +1,28 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/efureev/sauth/limit"
+	"github.com/efureev/sauth/logger"
+	"github.com/go-pkgz/rest"
+	"github.com/go-pkgz/rest/realip"
+)
+
+// checkLimits takes tokens of client ip, user and address from limits. Request exceeded any of them
+// rejected with 429 and Retry-After, false returned in this case.
+func checkLimits(w http.ResponseWriter, r *http.Request, l logger.L, limits limit.Limits, user, address string) bool {
+	ip, _ := realip.Get(r)
+	wait, err := limits.Check(ip, user, address)
+	if err != nil {
+		rest.SendErrorJSON(w, r, l, http.StatusInternalServerError, err, "failed to check limits")
+		return false
+	}
+	if wait > 0 {
+		limit.SetRetryAfter(w, wait)
+		rest.SendErrorJSON(w, r, l, http.StatusTooManyRequests, fmt.Errorf("limit exceeded"), "too many requests")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/efureev/sauth/mfa"
+	"github.com/efureev/sauth/token"
+)
+
+// mfaTokenDuration is a TTL of token issued to the user before second factor verified
+const mfaTokenDuration = 5 * time.Minute
+
+// requireSecondFactor marks claims of the user enrolled to second factor as pending. Such token is short-lived,
+// rejected by Authenticator and exchanged to the full token by `/mfa/verify` of auth handler.
+func requireSecondFactor(sf mfa.SecondFactor, claims *token.Claims) error {
+	if sf == nil || claims.User == nil {
+		return nil
+	}
+	enrolled, err := sf.Enrolled(claims.User.ID)
+	if err != nil {
+		return fmt.Errorf("can't check second factor of %s: %w", claims.User.ID, err)
+	}
+	if enrolled {
+		claims.MFARequired = true
+		claims.ExpiresAt = time.Now().Add(mfaTokenDuration).Unix()
+	}
+	return nil
+}
@@ -133,6 +133,11 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if u, err = resolveIdentity(w, r, h.IdentityStore, h.JwtService, h.name, u); err != nil {
+		rest.SendErrorJSON(w, r, h.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	cid, err := randToken()
 	if err != nil {
 		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make claim's id")
@@ -148,6 +153,13 @@ func (h Oauth1Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		SessionOnly: oauthClaims.SessionOnly,
 	}
 
+	claims.SetAuth(token.AMROAuth(h.name))
+
+	if err = requireSecondFactor(h.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err = h.JwtService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -136,7 +136,7 @@ func TestOauth1Logout(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, 200, resp.StatusCode)
 
-	assert.Equal(t, 2, len(resp.Cookies()))
+	assert.Equal(t, 6, len(resp.Cookies())) // jwt, xsrf and 4 jwt chunks
 	assert.Equal(t, "JWT", resp.Cookies()[0].Name, "token cookie cleared")
 	assert.Equal(t, "", resp.Cookies()[0].Value)
 	assert.Equal(t, "XSRF-TOKEN", resp.Cookies()[1].Name, "xsrf cookie cleared")
@@ -2,6 +2,9 @@ package provider
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -14,6 +17,7 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	"github.com/efureev/sauth/token"
 )
 
@@ -28,7 +32,9 @@ type Oauth2Handler struct {
 	scopes         []string
 	infoUrlMappers []Oauth2Mapper
 	//mapUser        func(UserRawData, []byte) token.User // map info from InfoURL to User
-	conf oauth2.Config
+	idToken    *idTokenVerifier               // verifies id_token of OpenID Connect providers, nonce sent if set
+	mapIDToken func(c UserRawData) token.User // maps verified id_token claims to User
+	conf       oauth2.Config
 }
 
 // Params to make initialized and ready to use provider
@@ -42,6 +48,11 @@ type Params struct {
 	AvatarSaver     AvatarSaver
 	AfterReceive    func(u *token.UserData) error
 	RedirectBuilder redirect.RedirectBuilderFn
+	PKCE            bool // use PKCE (S256) for oauth2 code exchange, required by some providers for public clients
+
+	UpstreamTokenStore UpstreamTokenStore // optional store of provider's tokens, used by UpstreamClient
+	IdentityStore      IdentityStore      // optional store of identities linked to canonical users
+	SecondFactor       mfa.SecondFactor   // optional second factor, required for enrolled users after login
 
 	Port int // relevant for providers supporting port customization, for example dev oauth2
 }
@@ -102,10 +113,34 @@ func (p Oauth2Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		aud = r.URL.Query().Get("aud")
 	}
 
+	var authOpts []oauth2.AuthCodeOption
+	var verifier string
+	if p.PKCE {
+		if verifier, err = pkceVerifier(); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make pkce verifier")
+			return
+		}
+		authOpts = append(authOpts,
+			oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	var nonce string
+	if p.idToken != nil {
+		if nonce, err = randToken(); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make nonce")
+			return
+		}
+		authOpts = append(authOpts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
 	claims := token.Claims{
 		Handshake: &token.Handshake{
-			State: state,
-			From:  r.URL.Query().Get("from"),
+			State:    state,
+			From:     r.URL.Query().Get("from"),
+			Verifier: verifier,
+			Nonce:    nonce,
 		},
 		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
 		StandardClaims: jwt.StandardClaims{
@@ -127,7 +162,7 @@ func (p Oauth2Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	p.conf.RedirectURL = p.makeRedirURL(r.URL.Path)
 
 	// return login url
-	loginURL := p.conf.AuthCodeURL(state)
+	loginURL := p.conf.AuthCodeURL(state, authOpts...)
 
 	p.Logf("[DEBUG] login url %s, claims=%+v", loginURL, claims)
 	p.performRedirect(w, r, loginURL)
@@ -161,7 +196,16 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	p.Logf("[DEBUG] token with state %s", retrievedState)
 
-	tok, err := p.conf.Exchange(context.Background(), r.URL.Query().Get("code"))
+	var exchangeOpts []oauth2.AuthCodeOption
+	if p.PKCE {
+		if oauthClaims.Handshake.Verifier == "" {
+			rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, nil, "missing pkce verifier")
+			return
+		}
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", oauthClaims.Handshake.Verifier))
+	}
+
+	tok, err := p.conf.Exchange(context.Background(), r.URL.Query().Get("code"), exchangeOpts...)
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "exchange failed")
 		return
@@ -171,7 +215,21 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	mapper := newMappers(client, p.Logf)
 
-	err = mapper.adds(p.infoUrlMappers...).get()
+	infoMappers := p.infoUrlMappers
+	var idUser *token.User
+	if p.idToken != nil {
+		if mapper.ctx, err = p.setIDTokenUser(r.Context(), tok, oauthClaims.Handshake.Nonce); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusForbidden, err, "invalid id token")
+			return
+		}
+		ud, _ := token.GetUserDataFromCtx(mapper.ctx)
+		idUser = &ud.User
+		if !userInfoIncomplete(ud.User) {
+			infoMappers = nil // id_token has everything, no need to call userinfo endpoint
+		}
+	}
+
+	err = mapper.adds(infoMappers...).get()
 	if err != nil {
 		if e, ok := err.(CodeError); ok {
 			rest.SendErrorJSON(w, r, p.L, e.code, e.err, e.message)
@@ -187,6 +245,13 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if idUser != nil {
+		uData.User = fillUserInfo(*idUser, uData.User)
+	}
+
+	upstream := p.upstreamToken(tok)
+	uData.Upstream = &upstream
+
 	if oauthClaims.NoAva {
 		uData.User.Picture = "" // reset picture on no avatar request
 	}
@@ -199,6 +264,11 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if uData.User, err = resolveIdentity(w, r, p.IdentityStore, p.JwtService, p.name, uData.User); err != nil {
+		rest.SendErrorJSON(w, r, p.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	if p.AfterReceive != nil {
 		if err := p.AfterReceive(uData); err != nil {
 			if e, ok := err.(CodeError); ok {
@@ -210,6 +280,13 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if p.UpstreamTokenStore != nil {
+		if err = p.UpstreamTokenStore.Put(uData.User.ID, upstream); err != nil {
+			rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to save upstream token")
+			return
+		}
+	}
+
 	cid, err := randToken()
 	if err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to make claim's id")
@@ -226,6 +303,13 @@ func (p Oauth2Handler) AuthHandler(w http.ResponseWriter, r *http.Request) {
 		NoAva:       oauthClaims.NoAva,
 	}
 
+	claims.SetAuth(token.AMROAuth(p.name))
+
+	if err = requireSecondFactor(p.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err = p.JwtService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, p.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -260,6 +344,21 @@ func (p Oauth2Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	p.JwtService.Reset(w)
 }
 
+// pkceVerifier makes random code verifier, 43 chars of base64url (RFC 7636)
+func pkceVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("can't get random: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge makes S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
 func (p Oauth2Handler) makeRedirURL(path string) string {
 	elems := strings.Split(path, "/")
 	newPath := strings.Join(elems[:len(elems)-1], "/")
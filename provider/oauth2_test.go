@@ -12,11 +12,14 @@ import (
 	"testing"
 	"time"
 
+	goauth2 "github.com/go-oauth2/oauth2/v4"
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
 
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/redirect"
 	"github.com/efureev/sauth/token"
 )
 
@@ -80,6 +83,68 @@ func TestOauth2Login(t *testing.T) {
 		Attributes: map[string]interface{}{"admin": true}}, u)
 }
 
+func TestOauth2LoginPKCE(t *testing.T) {
+	var challenges []string
+	teardown := prepOauth2Test(t, 8981, 8982, pkceOpt)
+	defer teardown()
+
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.Contains(req.URL.Path, "/login/oauth/authorize") {
+				assert.Equal(t, "S256", req.URL.Query().Get("code_challenge_method"))
+				challenges = append(challenges, req.URL.Query().Get("code_challenge"))
+			}
+			return nil
+		}}
+
+	resp, err := client.Get("http://localhost:8981/login?site=remark")
+	require.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	u := token.User{}
+	err = json.Unmarshal(body, &u)
+	assert.Nil(t, err)
+	assert.Equal(t, "mock_myuser1", u.ID)
+
+	require.Equal(t, 1, len(challenges))
+	assert.Equal(t, 43, len(challenges[0]), "base64url of sha256")
+}
+
+func pkceOpt(p *Params) {
+	p.PKCE = true
+	p.RedirectBuilder = redirect.DefaultRedirect()
+}
+
+func TestOauth2CallbackWithoutVerifier(t *testing.T) {
+	teardown := prepOauth2Test(t, 8981, 8982, pkceOpt)
+	defer teardown()
+
+	// handshake token issued without pkce verifier
+	jwtSvc := token.NewService(token.Opts{SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour})
+	tkn, err := jwtSvc.Token(token.Claims{Handshake: &token.Handshake{State: "12345"},
+		StandardClaims: jwt.StandardClaims{Id: "id1", ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://localhost:8981/callback?code=g0ZGZmNjVmOWI&state=12345&token=" + tkn)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	v, err := pkceVerifier()
+	require.NoError(t, err)
+	assert.Equal(t, 43, len(v))
+
+	// cross-check with go-oauth2/oauth2 server validation
+	assert.True(t, goauth2.CodeChallengeS256.Validate(pkceChallenge(v), v))
+	assert.False(t, goauth2.CodeChallengeS256.Validate(pkceChallenge(v), v+"x"))
+}
+
 func TestOauth2LoginSessionOnly(t *testing.T) {
 
 	teardown := prepOauth2Test(t, 8981, 8982)
@@ -173,7 +238,7 @@ func TestOauth2Logout(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, 200, resp.StatusCode)
 
-	assert.Equal(t, 2, len(resp.Cookies()))
+	assert.Equal(t, 6, len(resp.Cookies())) // jwt, xsrf and 4 jwt chunks
 	assert.Equal(t, "JWT", resp.Cookies()[0].Name, "token cookie cleared")
 	assert.Equal(t, "", resp.Cookies()[0].Value)
 	assert.Equal(t, "XSRF-TOKEN", resp.Cookies()[1].Name, "xsrf cookie cleared")
@@ -221,7 +286,7 @@ func TestMakeRedirURL(t *testing.T) {
 	}
 }
 
-func prepOauth2Test(t *testing.T, loginPort, authPort int) func() {
+func prepOauth2Test(t *testing.T, loginPort, authPort int, opts ...func(p *Params)) func() {
 
 	provider := Oauth2Handler{
 		name: "mock",
@@ -271,6 +336,9 @@ func prepOauth2Test(t *testing.T, loginPort, authPort int) func() {
 
 	params := Params{URL: "url", Cid: "cid", Csecret: "csecret", JwtService: jwtService,
 		Issuer: "remark42", AvatarSaver: &mockAvatarSaver{}, L: logger.Std}
+	for _, opt := range opts {
+		opt(&params)
+	}
 
 	provider = initOauth2Handler(params, provider)
 	svc := Service{Provider: provider}
@@ -279,6 +347,7 @@ func prepOauth2Test(t *testing.T, loginPort, authPort int) func() {
 
 	count := 0
 	useIds := []string{"myuser1", "myuser2"} // user for first ans second calls
+	challenge := ""                          // pkce code challenge, checked against code verifier on exchange
 
 	// nolint dupl
 	oauth := &http.Server{
@@ -288,10 +357,15 @@ func prepOauth2Test(t *testing.T, loginPort, authPort int) func() {
 			switch {
 			case strings.HasPrefix(r.URL.Path, "/login/oauth/authorize"):
 				state := r.URL.Query().Get("state")
+				challenge = r.URL.Query().Get("code_challenge")
 				w.Header().Add("Location", fmt.Sprintf("http://localhost:%d/callback?code=g0ZGZmNjVmOWI&state=%s",
 					loginPort, state))
 				w.WriteHeader(302)
 			case strings.HasPrefix(r.URL.Path, "/login/oauth/access_token"):
+				if challenge != "" && pkceChallenge(r.FormValue("code_verifier")) != challenge {
+					w.WriteHeader(400)
+					return
+				}
 				res := `{
 					"access_token":"MTQ0NjJkZmQ5OTM2NDE1ZTZjNGZmZjI3",
 					"token_type":"bearer",
@@ -0,0 +1,302 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha1" //nolint
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+
+	"github.com/efureev/sauth/token"
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// idTokenLeeway is tolerated clock skew between the issuer and the service for exp, iat and nbf of id_token
+const idTokenLeeway = time.Minute
+
+// OIDCOpt are options to initialize generic OpenID Connect provider
+type OIDCOpt struct {
+	Name    string                         // provider name, "oidc" if not set
+	Scopes  []string                       // requested scopes, "openid", "profile" and "email" if not set
+	MapUser func(c UserRawData) token.User // maps verified id_token claims to user, optional
+}
+
+// oidcDiscovery is a part of OpenID Provider Metadata used by the provider
+type oidcDiscovery struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+	JWKSURL     string `json:"jwks_uri"`
+}
+
+// NewOIDC makes generic OpenID Connect provider. Endpoints and signing keys of the issuer are discovered from
+// issuerURL/.well-known/openid-configuration. User made from the claims of id_token, verified with issuer's keys.
+func NewOIDC(p Params, issuerURL string, opts OIDCOpt) (Oauth2Handler, error) {
+	if opts.Name == "" {
+		opts.Name = "oidc"
+	}
+	if len(opts.Scopes) == 0 {
+		opts.Scopes = []string{"openid", "profile", "email"}
+	}
+	if opts.MapUser == nil {
+		opts.MapUser = oidcMapUser(opts.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	disc, err := fetchOIDCDiscovery(ctx, issuerURL)
+	if err != nil {
+		return Oauth2Handler{}, err
+	}
+
+	return initOauth2Handler(p, Oauth2Handler{
+		name:       opts.Name,
+		endpoint:   oauth2.Endpoint{AuthURL: disc.AuthURL, TokenURL: disc.TokenURL},
+		scopes:     opts.Scopes,
+		idToken:    newIDTokenVerifier(p.Cid, disc.JWKSURL, disc.Issuer),
+		mapIDToken: opts.MapUser,
+	}), nil
+}
+
+// fetchOIDCDiscovery loads provider metadata, issuer in metadata must match issuerURL
+func fetchOIDCDiscovery(ctx context.Context, issuerURL string) (res oidcDiscovery, err error) {
+	issuerURL = strings.TrimSuffix(issuerURL, "/")
+	if err = getJSON(ctx, issuerURL+oidcDiscoveryPath, &res); err != nil {
+		return res, fmt.Errorf("failed to discover %s: %w", issuerURL, err)
+	}
+	if strings.TrimSuffix(res.Issuer, "/") != issuerURL {
+		return res, fmt.Errorf("issuer mismatch, expected %s, got %s", issuerURL, res.Issuer)
+	}
+	if res.AuthURL == "" || res.TokenURL == "" || res.JWKSURL == "" {
+		return res, fmt.Errorf("incomplete discovery document of %s", issuerURL)
+	}
+	return res, nil
+}
+
+// oidcMapUser makes user from standard claims, id is hash of subject prefixed with provider name
+func oidcMapUser(name string) func(c UserRawData) token.User {
+	return func(c UserRawData) token.User {
+		hid := token.HashID(sha1.New(), c.Value("sub"))
+		u := token.User{
+			ID:      name + "_" + hid,
+			Name:    c.Value("name"),
+			Picture: c.Value("picture"),
+			Email:   c.Value("email"),
+		}
+		if u.Name == "" {
+			u.Name = c.Value("preferred_username")
+		}
+		if u.Name == "" {
+			u.Name = "noname_" + hid[:8]
+		}
+		return u
+	}
+}
+
+// setIDTokenUser verifies id_token of the exchanged token and puts user made from its claims to ctx
+func (p Oauth2Handler) setIDTokenUser(ctx context.Context, tok *oauth2.Token, nonce string) (context.Context, error) {
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return ctx, fmt.Errorf("no id_token in response")
+	}
+	claims, err := p.idToken.verify(ctx, raw, nonce)
+	if err != nil {
+		return ctx, err
+	}
+
+	ud := token.UserData{User: p.mapIDToken(claims)}
+	ud.SetRaw("id_token", map[string]interface{}(claims))
+	if ud.User.Email != "" {
+		ud.CreateEmailCollection().Add(ud.User.Email, claims.Value("email_verified") == "true")
+	}
+	return token.SetUserDataToCtx(ctx, ud), nil
+}
+
+// userInfoIncomplete checks if user made from id_token misses fields userinfo endpoint can provide
+func userInfoIncomplete(u token.User) bool {
+	return u.Name == "" || u.Email == "" || u.Picture == ""
+}
+
+// fillUserInfo sets empty fields of the user made from id_token with values from userinfo endpoint
+func fillUserInfo(u, info token.User) token.User {
+	if u.Name == "" {
+		u.Name = info.Name
+	}
+	if u.Email == "" {
+		u.Email = info.Email
+	}
+	if u.Picture == "" {
+		u.Picture = info.Picture
+	}
+	return u
+}
+
+// idTokenVerifier checks signature and standard claims of id_token.
+// Issuer's keys fetched on demand and refreshed on unknown kid, but not more often than once per minute.
+type idTokenVerifier struct {
+	clientID string
+	jwksURL  string
+	issuers  []string // allowed issuers, "{tenantid}" replaced by tid claim for multi-tenant providers
+
+	lock      sync.Mutex
+	keys      map[string]token.Key
+	lastFetch time.Time
+}
+
+func newIDTokenVerifier(clientID, jwksURL string, issuers ...string) *idTokenVerifier {
+	return &idTokenVerifier{clientID: clientID, jwksURL: jwksURL, issuers: issuers, keys: map[string]token.Key{}}
+}
+
+// verify checks id_token signature, iss, aud, azp, exp, iat, nbf and nonce (if expected nonce not empty).
+// Time claims checked with idTokenLeeway, parser's own validation has no tolerance and skipped.
+func (v *idTokenVerifier) verify(ctx context.Context, raw, nonce string) (UserRawData, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		key, err := v.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Method != nil && key.Method.Alg() != t.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", t.Method.Alg(), kid)
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't parse id_token: %w", err)
+	}
+
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("no subject in id_token")
+	}
+	if !v.validIssuer(claims) {
+		return nil, fmt.Errorf("invalid issuer %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(v.clientID, true) {
+		return nil, fmt.Errorf("invalid audience %v", claims["aud"])
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != v.clientID {
+		return nil, fmt.Errorf("invalid authorized party %s", azp)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Add(-idTokenLeeway).Unix(), true) {
+		return nil, fmt.Errorf("id_token expired")
+	}
+	if !claims.VerifyIssuedAt(time.Now().Add(idTokenLeeway).Unix(), false) {
+		return nil, fmt.Errorf("id_token issued in the future")
+	}
+	if !claims.VerifyNotBefore(time.Now().Add(idTokenLeeway).Unix(), false) {
+		return nil, fmt.Errorf("id_token not valid yet")
+	}
+	if got, _ := claims["nonce"].(string); nonce != "" && got != nonce {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	return UserRawData(claims), nil
+}
+
+func (v *idTokenVerifier) validIssuer(claims jwt.MapClaims) bool {
+	tid, _ := claims["tid"].(string)
+	for _, iss := range v.issuers {
+		if strings.Contains(iss, "{tenantid}") {
+			if tid == "" {
+				continue
+			}
+			iss = strings.ReplaceAll(iss, "{tenantid}", tid)
+		}
+		if claims.VerifyIssuer(iss, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns issuer's key by kid, empty kid allowed for the issuer with a single key
+func (v *idTokenVerifier) key(ctx context.Context, kid string) (token.Key, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if k, ok := v.lookup(kid); ok {
+		return k, nil
+	}
+	if time.Since(v.lastFetch) < time.Minute {
+		return token.Key{}, fmt.Errorf("key %q not found", kid)
+	}
+
+	jwks := token.JWKS{}
+	if err := getJSON(ctx, v.jwksURL, &jwks); err != nil {
+		return token.Key{}, fmt.Errorf("failed to fetch keys: %w", err)
+	}
+	v.lastFetch = time.Now()
+	keys := map[string]token.Key{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Usage != "" && jwk.Usage != "sig" {
+			continue
+		}
+		k, err := jwk.Key()
+		if err != nil {
+			continue // skip keys of unsupported types
+		}
+		if jwk.Algorithm == "" {
+			k.Method = nil // any algorithm of the key type allowed
+		}
+		keys[k.ID] = k
+	}
+	v.keys = keys
+
+	if k, ok := v.lookup(kid); ok {
+		return k, nil
+	}
+	return token.Key{}, fmt.Errorf("key %q not found", kid)
+}
+
+func (v *idTokenVerifier) lookup(kid string) (token.Key, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// getJSON makes GET request and decodes json response to res
+func getJSON(ctx context.Context, url string, res interface{}) error {
+	client := http.Client{Timeout: time.Second * 5}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	req.Header.Add("accept", AcceptJSONHeader)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if err = json.Unmarshal(data, res); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
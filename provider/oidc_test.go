@@ -0,0 +1,291 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/redirect"
+	"github.com/efureev/sauth/token"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockOIDC(t)
+	defer idp.Close()
+
+	jwtService := token.NewService(token.Opts{
+		SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+	})
+	params := Params{URL: "url", Cid: "cid", Csecret: "csecret", JwtService: jwtService, Issuer: "remark42",
+		L: logger.Std, RedirectBuilder: redirect.DefaultRedirect()}
+
+	h, err := NewOIDC(params, idp.URL, OIDCOpt{Name: "keycloak"})
+	require.NoError(t, err)
+	assert.Equal(t, "keycloak", h.Name())
+	assert.Equal(t, []string{"openid", "profile", "email"}, h.scopes)
+
+	svc := Service{Provider: h}
+	ts := httptest.NewServer(http.HandlerFunc(svc.Handler))
+	defer ts.Close()
+	idp.callback = ts.URL + "/callback"
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+
+	resp, err := client.Get(ts.URL + "/login?site=remark")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(body, &u))
+	assert.Equal(t, token.User{ID: "keycloak_" + token.HashID(sha1.New(), "user-123"), Name: "John Doe",
+		Email: "john@example.com"}, u)
+	assert.NotEmpty(t, idp.nonce, "nonce sent to authorize endpoint")
+
+	// id_token with wrong nonce rejected
+	idp.claims = func(c jwt.MapClaims) { c["nonce"] = "bad" }
+	resp, err = client.Get(ts.URL + "/login?site=remark")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestOauth2IDTokenWithUserInfoFallback(t *testing.T) {
+	idp := newMockOIDC(t)
+	defer idp.Close()
+
+	jwtService := token.NewService(token.Opts{
+		SecretReader: token.SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+	})
+	params := Params{URL: "url", Cid: "cid", Csecret: "csecret", JwtService: jwtService, Issuer: "remark42",
+		L: logger.Std, RedirectBuilder: redirect.DefaultRedirect()}
+
+	// google provider pointed to mock
+	h := NewGoogle(params)
+	h.conf.Endpoint = oauth2.Endpoint{AuthURL: idp.URL + "/auth", TokenURL: idp.URL + "/token"}
+	h.idToken = newIDTokenVerifier("cid", idp.URL+"/keys", idp.URL)
+	h.infoUrlMappers[0].infoURL = idp.URL + "/userinfo"
+
+	svc := Service{Provider: h}
+	ts := httptest.NewServer(http.HandlerFunc(svc.Handler))
+	defer ts.Close()
+	idp.callback = ts.URL + "/callback"
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+
+	// id_token without picture, userinfo called for it only
+	resp, err := client.Get(ts.URL + "/login")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	u := token.User{}
+	require.NoError(t, json.Unmarshal(body, &u))
+	assert.Equal(t, token.User{ID: "user-123", Name: "John Doe", Email: "john@example.com",
+		Picture: "http://example.com/john.png"}, u)
+	assert.Equal(t, 1, idp.userInfo)
+
+	// complete id_token, no userinfo call
+	idp.claims = func(c jwt.MapClaims) { c["picture"] = "http://example.com/pic.png" }
+	resp, err = client.Get(ts.URL + "/login")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	u = token.User{}
+	require.NoError(t, json.Unmarshal(body, &u))
+	assert.Equal(t, "http://example.com/pic.png", u.Picture)
+	assert.Equal(t, 1, idp.userInfo)
+}
+
+func TestIDTokenVerifierTenantIssuer(t *testing.T) {
+	idp := newMockOIDC(t)
+	defer idp.Close()
+	v := newIDTokenVerifier("cid", idp.URL+"/keys", "https://login.example.com/{tenantid}/v2.0")
+
+	c := idp.makeClaims("")
+	c["tid"] = "tenant1"
+	c["iss"] = "https://login.example.com/tenant1/v2.0"
+	_, err := v.verify(context.Background(), idp.sign(t, c, "k1"), "")
+	assert.NoError(t, err)
+
+	c["iss"] = "https://login.example.com/tenant2/v2.0"
+	_, err = v.verify(context.Background(), idp.sign(t, c, "k1"), "")
+	assert.Error(t, err)
+
+	delete(c, "tid")
+	c["iss"] = "https://login.example.com/{tenantid}/v2.0"
+	_, err = v.verify(context.Background(), idp.sign(t, c, "k1"), "")
+	assert.Error(t, err)
+}
+
+func TestNewOIDCDiscoveryFailed(t *testing.T) {
+	idp := newMockOIDC(t)
+	defer idp.Close()
+	idp.issuer = "https://other.example.com"
+
+	_, err := NewOIDC(Params{Cid: "cid"}, idp.URL, OIDCOpt{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "issuer mismatch")
+
+	_, err = NewOIDC(Params{Cid: "cid"}, idp.URL+"/bad", OIDCOpt{})
+	require.Error(t, err)
+}
+
+func TestIDTokenVerifier(t *testing.T) {
+	idp := newMockOIDC(t)
+	defer idp.Close()
+	v := newIDTokenVerifier("cid", idp.URL+"/keys", idp.URL)
+
+	tbl := []struct {
+		name  string
+		upd   func(c jwt.MapClaims)
+		kid   string
+		nonce string
+		err   string
+	}{
+		{name: "valid", kid: "k1", nonce: "n1"},
+		{name: "valid, nonce not expected", kid: "k1"},
+		{name: "valid, multiple audiences", kid: "k1", upd: func(c jwt.MapClaims) { c["aud"] = []string{"other", "cid"} }},
+		{name: "wrong nonce", kid: "k1", nonce: "n2", err: "invalid nonce"},
+		{name: "wrong audience", kid: "k1", upd: func(c jwt.MapClaims) { c["aud"] = "other" }, err: "invalid audience"},
+		{name: "wrong azp", kid: "k1", upd: func(c jwt.MapClaims) { c["azp"] = "other" }, err: "invalid authorized party"},
+		{name: "wrong issuer", kid: "k1", upd: func(c jwt.MapClaims) { c["iss"] = "other" }, err: "invalid issuer"},
+		{name: "no subject", kid: "k1", upd: func(c jwt.MapClaims) { delete(c, "sub") }, err: "no subject"},
+		{name: "expired", kid: "k1", upd: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() },
+			err: "expired"},
+		{name: "expired within leeway", kid: "k1",
+			upd: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }},
+		{name: "issued in the future within leeway", kid: "k1",
+			upd: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(30 * time.Second).Unix() }},
+		{name: "issued in the future", kid: "k1", upd: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(5 * time.Minute).Unix() },
+			err: "issued in the future"},
+		{name: "not valid yet within leeway", kid: "k1",
+			upd: func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(30 * time.Second).Unix() }},
+		{name: "not valid yet", kid: "k1", upd: func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(5 * time.Minute).Unix() },
+			err: "not valid yet"},
+		{name: "no exp", kid: "k1", upd: func(c jwt.MapClaims) { delete(c, "exp") }, err: "expired"},
+		{name: "unknown kid", kid: "k2", err: `key "k2" not found`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			c := idp.makeClaims("n1")
+			if tt.upd != nil {
+				tt.upd(c)
+			}
+			raw := idp.sign(t, c, tt.kid)
+			claims, err := v.verify(context.Background(), raw, tt.nonce)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "user-123", claims.Value("sub"))
+		})
+	}
+
+	// hmac signed token rejected
+	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.makeClaims("n1"))
+	tkn.Header["kid"] = "k1"
+	raw, err := tkn.SignedString([]byte("cid"))
+	require.NoError(t, err)
+	_, err = v.verify(context.Background(), raw, "n1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected signing method")
+}
+
+type mockOIDC struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	issuer   string
+	callback string
+	nonce    string
+	claims   func(c jwt.MapClaims)
+	userInfo int // number of userinfo calls
+}
+
+// newMockOIDC starts OpenID Connect provider with discovery, keys, authorize and token endpoints
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m := &mockOIDC{key: key}
+
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%s/auth","token_endpoint":"%s/token",`+
+				`"jwks_uri":"%s/keys"}`, m.issuer, m.URL, m.URL, m.URL)
+		case "/keys":
+			k, e := token.NewPublicKey("k1", &m.key.PublicKey)
+			require.NoError(t, e)
+			jwk, e := k.JWK()
+			require.NoError(t, e)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(token.JWKS{Keys: []token.JWK{jwk}})
+		case "/auth":
+			m.nonce = r.URL.Query().Get("nonce")
+			http.Redirect(w, r, fmt.Sprintf("%s?code=abcdef&state=%s", m.callback, r.URL.Query().Get("state")),
+				http.StatusFound)
+		case "/token":
+			c := m.makeClaims(m.nonce)
+			if m.claims != nil {
+				m.claims(c)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"access_token":"at","token_type":"bearer","expires_in":3600,"id_token":%q}`,
+				m.sign(t, c, "k1"))
+		case "/userinfo":
+			m.userInfo++
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `{"sub":"user-123","name":"John","email":"john@example.com",`+
+				`"picture":"http://example.com/john.png"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	m.issuer = m.URL
+	return m
+}
+
+func (m *mockOIDC) makeClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   m.URL,
+		"sub":   "user-123",
+		"aud":   "cid",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+		"name":  "John Doe",
+		"email": "john@example.com",
+	}
+}
+
+func (m *mockOIDC) sign(t *testing.T, c jwt.MapClaims, kid string) string {
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tkn.Header["kid"] = kid
+	res, err := tkn.SignedString(m.key)
+	require.NoError(t, err)
+	return res
+}
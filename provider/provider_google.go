@@ -8,15 +8,26 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
-// NewGoogle makes google oauth2 provider
+const (
+	googleKeysURL = "https://www.googleapis.com/oauth2/v3/certs"
+	googleIssuer  = "https://accounts.google.com"
+)
+
+// NewGoogle makes google oauth2 provider. User made from verified id_token,
+// userinfo endpoint called only if id_token misses some of the fields.
 func NewGoogle(p Params) Oauth2Handler {
 	return initOauth2Handler(p, Oauth2Handler{
 		name:     "google",
 		endpoint: google.Endpoint,
-		//scopes:   []string{"email", "profile"},
-		scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.profile",
-			"https://www.googleapis.com/auth/userinfo.email",
+		scopes:   []string{"openid", "email", "profile"},
+		idToken:  newIDTokenVerifier(p.Cid, googleKeysURL, googleIssuer, "accounts.google.com"),
+		mapIDToken: func(c UserRawData) token.User {
+			return token.User{
+				ID:      c.Value("sub"),
+				Name:    c.Value("name"),
+				Picture: c.Value("picture"),
+				Email:   c.Value("email"),
+			}
 		},
 		//See https://tech.yandex.com/passport/doc/dg/reference/response-docpage/
 		infoUrlMappers: []Oauth2Mapper{
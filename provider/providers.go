@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha1" //nolint
 	"encoding/json"
+	"strings"
 
 	"github.com/dghubble/oauth1"
 	"github.com/dghubble/oauth1/twitter"
@@ -66,12 +67,32 @@ func NewBattlenet(p Params) Oauth2Handler {
 	})
 }
 
-// NewMicrosoft makes microsoft azure oauth2 provider
+const (
+	microsoftKeysURL = "https://login.microsoftonline.com/common/discovery/v2.0/keys"
+	microsoftIssuer  = "https://login.microsoftonline.com/{tenantid}/v2.0"
+	microsoftPicture = "https://graph.microsoft.com/beta/me/photo/$value"
+)
+
+// NewMicrosoft makes microsoft azure oauth2 provider. User made from verified id_token,
+// graph api called only if id_token misses some of the fields.
 func NewMicrosoft(p Params) Oauth2Handler {
 	return initOauth2Handler(p, Oauth2Handler{
 		name:     "microsoft",
 		endpoint: microsoft.AzureADEndpoint("common"),
-		scopes:   []string{"User.Read"},
+		scopes:   []string{"openid", "profile", "email", "User.Read"},
+		idToken:  newIDTokenVerifier(p.Cid, microsoftKeysURL, microsoftIssuer),
+		mapIDToken: func(c UserRawData) token.User {
+			oid := c.Value("oid") // the same object id graph api returns as id
+			if oid == "" {
+				oid = c.Value("sub")
+			}
+			return token.User{
+				ID:      "microsoft_" + token.HashID(sha1.New(), oid),
+				Name:    c.Value("name"),
+				Picture: microsoftPicture,
+				Email:   microsoftVerifiedEmail(c),
+			}
+		},
 		infoUrlMappers: []Oauth2Mapper{
 			NewOauth2Mapper(
 				"https://graph.microsoft.com/v1.0/me",
@@ -85,7 +106,8 @@ func NewMicrosoft(p Params) Oauth2Handler {
 					return token.User{
 						ID:      "microsoft_" + token.HashID(sha1.New(), userRawData.Value("id")),
 						Name:    userRawData.Value("displayName"),
-						Picture: "https://graph.microsoft.com/beta/me/photo/$value",
+						Picture: microsoftPicture,
+						Email:   userRawData.Value("mail"),
 					}
 				},
 				UserRawData{},
@@ -94,6 +116,22 @@ func NewMicrosoft(p Params) Oauth2Handler {
 	})
 }
 
+// microsoftVerifiedEmail returns email claim of id_token only if the tenant verified it, as the claim is mutable
+// and not verified by default. Verification marked by optional claims xms_edov or verified_primary_email.
+func microsoftVerifiedEmail(c UserRawData) string {
+	email := c.Value("email")
+	if email == "" || c.Value("xms_edov") == "true" {
+		return email
+	}
+	verified, _ := c["verified_primary_email"].([]interface{})
+	for _, v := range verified {
+		if s, ok := v.(string); ok && strings.EqualFold(s, email) {
+			return email
+		}
+	}
+	return ""
+}
+
 // NewPatreon makes patreon oauth2 provider
 func NewPatreon(p Params) Oauth2Handler {
 	type uinfo struct {
@@ -52,6 +52,36 @@ func TestProviders_NewGoogle(t *testing.T) {
 	}, uData, "got %+v", uData)
 }
 
+func TestProviders_IDTokenUsers(t *testing.T) {
+	r := NewGoogle(Params{URL: "http://demo.remark42.com", Cid: "cid", Csecret: "cs"})
+	assert.Equal(t, []string{"https://accounts.google.com", "accounts.google.com"}, r.idToken.issuers)
+	assert.Equal(t, "cid", r.idToken.clientID)
+	assert.Equal(t, token.User{ID: "1234567890", Name: "test user", Email: "test@google.com",
+		Picture: "http://demo.remark42.com/blah.png"},
+		r.mapIDToken(UserRawData{"sub": "1234567890", "name": "test user", "email": "test@google.com",
+			"picture": "http://demo.remark42.com/blah.png"}))
+
+	r = NewMicrosoft(Params{URL: "http://demo.remark42.com", Cid: "cid", Csecret: "cs"})
+	assert.Equal(t, []string{"https://login.microsoftonline.com/{tenantid}/v2.0"}, r.idToken.issuers)
+	u := r.mapIDToken(UserRawData{"sub": "sub1", "oid": "myid", "name": "test user", "email": "test@example.com",
+		"xms_edov": true})
+	assert.Equal(t, token.User{ID: "microsoft_6e34471f84557e1713012d64a7477c71bfdac631", Name: "test user",
+		Email: "test@example.com", Picture: "https://graph.microsoft.com/beta/me/photo/$value"}, u)
+	assert.False(t, userInfoIncomplete(u))
+
+	u = r.mapIDToken(UserRawData{"sub": "sub1", "oid": "myid", "name": "test user", "email": "test@example.com"})
+	assert.Equal(t, "", u.Email, "unverified email dropped")
+	assert.True(t, userInfoIncomplete(u))
+
+	u = r.mapIDToken(UserRawData{"sub": "sub1", "oid": "myid", "name": "test user", "email": "Test@example.com",
+		"verified_primary_email": []interface{}{"test@example.com"}})
+	assert.Equal(t, "Test@example.com", u.Email)
+
+	u = r.mapIDToken(UserRawData{"sub": "sub1", "oid": "myid", "name": "test user", "email": "test@example.com",
+		"xms_edov": false, "verified_primary_email": []interface{}{"other@example.com"}})
+	assert.Equal(t, "", u.Email, "email not in verified list dropped")
+}
+
 /*
 func TestProviders_NewGithub(t *testing.T) {
 	r := NewGithub(Params{URL: "http://demo.remark42.com", Cid: "cid", Csecret: "cs"})
@@ -20,6 +20,7 @@ import (
 	"github.com/golang-jwt/jwt"
 
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	authtoken "github.com/efureev/sauth/token"
 )
 
@@ -34,6 +35,9 @@ type TelegramHandler struct {
 	AvatarSaver  AvatarSaver
 	Telegram     TelegramAPI
 
+	IdentityStore IdentityStore    // optional store of identities linked to canonical users
+	SecondFactor  mfa.SecondFactor // optional second factor, required for enrolled users after login
+
 	run      int32  // non-zero if Run goroutine has started
 	username string // bot username
 	requests struct {
@@ -300,6 +304,11 @@ func (th *TelegramHandler) LoginHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if u, err = resolveIdentity(w, r, th.IdentityStore, th.TokenService, th.ProviderName, u); err != nil {
+		rest.SendErrorJSON(w, r, th.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	claims := authtoken.Claims{
 		User: &u,
 		StandardClaims: jwt.StandardClaims{
@@ -312,6 +321,13 @@ func (th *TelegramHandler) LoginHandler(w http.ResponseWriter, r *http.Request)
 		SessionOnly: false, // TODO
 	}
 
+	claims.SetAuth(authtoken.AMRTelegram)
+
+	if err = requireSecondFactor(th.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, th.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err := th.TokenService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, th.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -190,7 +190,7 @@ func TestTelegramLogout(t *testing.T) {
 	assert.NoError(t, err)
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
-	assert.Equal(t, 2, len(rr.Header()["Set-Cookie"]))
+	assert.Equal(t, 6, len(rr.Header()["Set-Cookie"])) // jwt, xsrf and 4 jwt chunks
 
 	request := &http.Request{Header: http.Header{"Cookie": rr.Header()["Set-Cookie"]}}
 	c, err := request.Cookie("JWT")
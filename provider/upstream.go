@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/efureev/sauth/token"
+)
+
+// UpstreamTokenStore defines interface keeping oauth2 tokens issued by providers, per user and provider
+type UpstreamTokenStore interface {
+	Put(userID string, tok token.UpstreamToken) error
+	Get(userID, provider string) (token.UpstreamToken, error)
+}
+
+// UpstreamClientMaker implemented by providers able to make http client calling provider's api on behalf of the user
+type UpstreamClientMaker interface {
+	UpstreamClient(ctx context.Context, userID string) (*http.Client, error)
+}
+
+// UpstreamClient makes http client with stored upstream token of the user. Expired token refreshed
+// by the client with provider's refresh token, and the refreshed one saved back to the store.
+func (p Oauth2Handler) UpstreamClient(ctx context.Context, userID string) (*http.Client, error) {
+	if p.UpstreamTokenStore == nil {
+		return nil, fmt.Errorf("upstream token store not defined")
+	}
+	ut, err := p.UpstreamTokenStore.Get(userID, p.name)
+	if err != nil {
+		return nil, fmt.Errorf("can't get upstream token of %s for %s: %w", p.name, userID, err)
+	}
+
+	tok := &oauth2.Token{AccessToken: ut.AccessToken, TokenType: ut.TokenType, RefreshToken: ut.RefreshToken,
+		Expiry: ut.Expiry}
+	ts := &storingTokenSource{src: p.conf.TokenSource(ctx, tok), store: p.UpstreamTokenStore, userID: userID, last: ut}
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// upstreamToken makes UpstreamToken from exchanged oauth2 token.
+// Granted scopes taken from the response if provider returned them, requested scopes otherwise.
+func (p Oauth2Handler) upstreamToken(tok *oauth2.Token) token.UpstreamToken {
+	res := token.UpstreamToken{
+		Provider:     p.name,
+		AccessToken:  tok.AccessToken,
+		TokenType:    tok.TokenType,
+		RefreshToken: tok.RefreshToken,
+		Expiry:       tok.Expiry,
+		Scopes:       p.conf.Scopes,
+	}
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		res.Scopes = strings.FieldsFunc(scope, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return res
+}
+
+// storingTokenSource saves refreshed tokens to UpstreamTokenStore
+type storingTokenSource struct {
+	src    oauth2.TokenSource
+	store  UpstreamTokenStore
+	userID string
+
+	lock sync.Mutex
+	last token.UpstreamToken
+}
+
+// Token returns token of the underlying source, saves it if it was refreshed
+func (s *storingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if tok.AccessToken == s.last.AccessToken {
+		return tok, nil
+	}
+	ut := s.last
+	ut.AccessToken, ut.TokenType, ut.Expiry = tok.AccessToken, tok.TokenType, tok.Expiry
+	if tok.RefreshToken != "" {
+		ut.RefreshToken = tok.RefreshToken
+	}
+	if err = s.store.Put(s.userID, ut); err != nil {
+		return nil, fmt.Errorf("can't save refreshed upstream token: %w", err)
+	}
+	s.last = ut
+	return tok, nil
+}
+
+// MemUpstreamTokenStore implements UpstreamTokenStore in memory, thread safe
+type MemUpstreamTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]token.UpstreamToken
+}
+
+// NewMemUpstreamTokenStore makes in-memory upstream token store
+func NewMemUpstreamTokenStore() *MemUpstreamTokenStore {
+	return &MemUpstreamTokenStore{tokens: map[string]token.UpstreamToken{}}
+}
+
+// Put saves token of the user for tok.Provider
+func (m *MemUpstreamTokenStore) Put(userID string, tok token.UpstreamToken) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tokens[tok.Provider+"/"+userID] = tok
+	return nil
+}
+
+// Get returns token of the user for the provider
+func (m *MemUpstreamTokenStore) Get(userID, provider string) (token.UpstreamToken, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tok, ok := m.tokens[provider+"/"+userID]
+	if !ok {
+		return token.UpstreamToken{}, fmt.Errorf("upstream token not found")
+	}
+	return tok, nil
+}
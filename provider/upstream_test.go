@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/redirect"
+	"github.com/efureev/sauth/token"
+)
+
+func TestOauth2UpstreamToken(t *testing.T) {
+	store := NewMemUpstreamTokenStore()
+	var upstream *token.UpstreamToken
+	teardown := prepOauth2Test(t, 8981, 8982, func(p *Params) {
+		p.RedirectBuilder = redirect.DefaultRedirect()
+		p.UpstreamTokenStore = store
+		p.AfterReceive = func(u *token.UserData) error {
+			upstream = u.Upstream
+			return nil
+		}
+	})
+	defer teardown()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://localhost:8981/login?site=remark")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NotNil(t, upstream, "upstream token passed to AfterReceive")
+	assert.Equal(t, "mock", upstream.Provider)
+	assert.Equal(t, "MTQ0NjJkZmQ5OTM2NDE1ZTZjNGZmZjI3", upstream.AccessToken)
+	assert.Equal(t, "IwOGYzYTlmM2YxOTQ5MGE3YmNmMDFkNTVk", upstream.RefreshToken)
+	assert.Equal(t, []string{"create"}, upstream.Scopes)
+	assert.True(t, upstream.Expiry.After(time.Now().Add(59*time.Minute)))
+
+	stored, err := store.Get("mock_myuser1", "mock")
+	require.NoError(t, err)
+	assert.Equal(t, *upstream, stored)
+}
+
+func TestOauth2UpstreamClient(t *testing.T) {
+	refreshed := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "refresh_token", r.FormValue("grant_type"))
+			assert.Equal(t, "rt1", r.FormValue("refresh_token"))
+			refreshed++
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, `{"access_token":"at2","token_type":"bearer","expires_in":3600,"refresh_token":"rt2"}`)
+		case "/api":
+			_, _ = fmt.Fprint(w, r.Header.Get("Authorization"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	store := NewMemUpstreamTokenStore()
+	h := initOauth2Handler(Params{Cid: "cid", Csecret: "csecret", L: logger.NoOp, UpstreamTokenStore: store},
+		Oauth2Handler{name: "mock", endpoint: oauth2.Endpoint{AuthURL: ts.URL + "/auth", TokenURL: ts.URL + "/token"}})
+
+	_, err := h.UpstreamClient(context.Background(), "user1")
+	assert.Error(t, err, "no token for user")
+
+	require.NoError(t, store.Put("user1", token.UpstreamToken{Provider: "mock", AccessToken: "at1", TokenType: "bearer",
+		RefreshToken: "rt1", Expiry: time.Now().Add(-time.Minute), Scopes: []string{"read"}}))
+
+	client, err := h.UpstreamClient(context.Background(), "user1")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL + "/api")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer at2", string(body))
+	}
+	assert.Equal(t, 1, refreshed, "expired token refreshed once")
+
+	stored, err := store.Get("user1", "mock")
+	require.NoError(t, err)
+	assert.Equal(t, "at2", stored.AccessToken)
+	assert.Equal(t, "rt2", stored.RefreshToken)
+	assert.Equal(t, []string{"read"}, stored.Scopes)
+
+	_, err = initOauth2Handler(Params{L: logger.NoOp}, Oauth2Handler{name: "mock"}).UpstreamClient(context.Background(), "user1")
+	assert.EqualError(t, err, "upstream token store not defined")
+}
@@ -2,15 +2,22 @@ package provider
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"html/template"
+	"math/big"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/efureev/sauth/avatar"
+	"github.com/efureev/sauth/limit"
 	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
 	"github.com/efureev/sauth/token"
 	"github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt"
@@ -28,8 +35,24 @@ type VerifyHandler struct {
 	Sender       Sender
 	Template     string
 	UseGravatar  bool
+
+	IdentityStore IdentityStore    // optional store of identities linked to canonical users
+	SecondFactor  mfa.SecondFactor // optional second factor, required for enrolled users after login
+
+	ConfirmationStore ConfirmationStore // optional store making confirmations one-time, required for UseCode
+	UseCode           bool              // send numeric code instead of confirmation token
+	CodeAttempts      int               // max attempts to enter the code, default 5
+
+	Limits limit.Limits // optional limits of confirmations per ip and address
 }
 
+const (
+	confirmationTTL     = 30 * time.Minute
+	codeTTL             = 10 * time.Minute
+	codeDigits          = 6
+	defaultCodeAttempts = 5
+)
+
 // Sender defines interface to send emails
 type Sender interface {
 	Send(address, text string) error
@@ -56,7 +79,8 @@ type VerifTokenService interface {
 func (e VerifyHandler) Name() string { return e.ProviderName }
 
 // LoginHandler gets name and address from query, makes confirmation token and sends it to user.
-// In case if confirmation token presented in the query uses it to create auth token
+// In case if confirmation token presented in the query uses it to create auth token.
+// With UseCode the code sent to user should be presented along with confirmation token returned to the client.
 func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// GET /login?site=site&user=name&address=someone@example.com
@@ -67,18 +91,46 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// confirmation token presented
-	// GET /login?token=confirmation-jwt&sess=1
+	// GET /login?token=confirmation-jwt&sess=1 or GET /login?token=confirmation-jwt&code=123456&sess=1
+	if !checkLimits(w, r, e.L, e.Limits, "", "") {
+		return
+	}
 	confClaims, err := e.TokenService.Parse(tkn)
 	if err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, err, "failed to verify confirmation token")
 		return
 	}
 
+	// token made by other provider or in other mode, i.e. code token returned to client can't be used as link
+	if confClaims.Handshake == nil || confClaims.Handshake.State != e.handshakeState() {
+		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, fmt.Errorf("confirmation of other provider or mode"),
+			"failed to verify confirmation token")
+		return
+	}
+
 	if e.TokenService.IsExpired(confClaims) {
 		rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, fmt.Errorf("expired"), "failed to verify confirmation token")
 		return
 	}
 
+	if e.UseCode {
+		if err = e.checkCode(confClaims.Id, r.URL.Query().Get("code")); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, err, "failed to verify confirmation code")
+			return
+		}
+	}
+
+	if e.ConfirmationStore != nil {
+		if confClaims.Id == "" {
+			rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, fmt.Errorf("no token id"), "failed to use confirmation token")
+			return
+		}
+		if err = e.ConfirmationStore.Use(confClaims.Id, time.Unix(confClaims.ExpiresAt, 0)); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusForbidden, err, "failed to use confirmation token")
+			return
+		}
+	}
+
 	elems := strings.Split(confClaims.Handshake.ID, "::")
 	if len(elems) != 2 {
 		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, fmt.Errorf(confClaims.Handshake.ID), "invalid handshake token")
@@ -103,6 +155,11 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if u, err = resolveIdentity(w, r, e.IdentityStore, e.TokenService, e.ProviderName, u); err != nil {
+		rest.SendErrorJSON(w, r, e.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
 	cid, err := randToken()
 	if err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make token id")
@@ -119,6 +176,13 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		SessionOnly: sessOnly,
 	}
 
+	claims.SetAuth(token.AMREmailLink)
+
+	if err = requireSecondFactor(e.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+
 	if _, err = e.TokenService.Set(w, claims); err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "failed to set token")
 		return
@@ -130,6 +194,14 @@ func (e VerifyHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	rest.RenderJSON(w, claims.User)
 }
 
+// handshakeState binds confirmation token to the provider and its mode, "name::link" or "name::code"
+func (e VerifyHandler) handshakeState() string {
+	if e.UseCode {
+		return e.ProviderName + "::code"
+	}
+	return e.ProviderName + "::link"
+}
+
 // GET /login?site=site&user=name&address=someone@example.com
 func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request) {
 	user, address := r.URL.Query().Get("user"), r.URL.Query().Get("address")
@@ -141,15 +213,45 @@ func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request)
 		rest.SendErrorJSON(w, r, e.L, http.StatusBadRequest, fmt.Errorf("wrong request"), "can't get user and address")
 		return
 	}
+
+	if !checkLimits(w, r, e.L, e.Limits, "", address) {
+		return
+	}
+
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make token id")
+		return
+	}
+
+	ttl, code := confirmationTTL, ""
+	if e.UseCode {
+		if e.ConfirmationStore == nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError,
+				fmt.Errorf("no confirmation store"), "no confirmation store")
+			return
+		}
+		ttl = codeTTL
+		if code, err = randCode(codeDigits); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't make confirmation code")
+			return
+		}
+		if err = e.ConfirmationStore.PutCode(cid, hashCode(cid, code), time.Now().Add(ttl)); err != nil {
+			rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't save confirmation code")
+			return
+		}
+	}
+
 	claims := token.Claims{
 		Handshake: &token.Handshake{
-			State: "",
+			State: e.handshakeState(),
 			ID:    user + "::" + address,
 		},
 		SessionOnly: r.URL.Query().Get("session") != "" && r.URL.Query().Get("session") != "0",
 		StandardClaims: jwt.StandardClaims{
+			Id:        cid,
 			Audience:  e.sanitize(r.URL.Query().Get("site")),
-			ExpiresAt: time.Now().Add(30 * time.Minute).Unix(),
+			ExpiresAt: time.Now().Add(ttl).Unix(),
 			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
 			Issuer:    e.Issuer,
 		},
@@ -162,6 +264,9 @@ func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request)
 	}
 
 	tmpl := msgTemplate
+	if e.UseCode {
+		tmpl = codeMsgTemplate
+	}
 	if e.Template != "" {
 		tmpl = e.Template
 	}
@@ -175,13 +280,18 @@ func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request)
 		User    string
 		Address string
 		Token   string
+		Code    string
 		Site    string
 	}{
 		User:    user,
 		Address: address,
-		Token:   tkn,
 		Site:    r.URL.Query().Get("site"),
 	}
+	if e.UseCode {
+		tmplData.Code = code
+	} else {
+		tmplData.Token = tkn
+	}
 	buf := bytes.Buffer{}
 	if err = emailTmpl.Execute(&buf, tmplData); err != nil {
 		rest.SendErrorJSON(w, r, e.L, http.StatusInternalServerError, err, "can't execute confirmation template")
@@ -193,9 +303,55 @@ func (e VerifyHandler) sendConfirmation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if e.UseCode { // token is useless without the code, client presents it along with the code entered by user
+		rest.RenderJSON(w, rest.JSON{"user": user, "address": address, "token": tkn})
+		return
+	}
 	rest.RenderJSON(w, rest.JSON{"user": user, "address": address})
 }
 
+// checkCode verifies the code entered for confirmation, each call counted as an attempt
+func (e VerifyHandler) checkCode(id, code string) error {
+	if id == "" || code == "" {
+		return fmt.Errorf("no code")
+	}
+	if e.ConfirmationStore == nil {
+		return fmt.Errorf("no confirmation store")
+	}
+	hash, attempts, err := e.ConfirmationStore.Attempt(id)
+	if err != nil {
+		return fmt.Errorf("can't get confirmation code: %w", err)
+	}
+	if hash == "" {
+		return fmt.Errorf("code expired")
+	}
+	maxAttempts := e.CodeAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultCodeAttempts
+	}
+	if attempts > maxAttempts {
+		return fmt.Errorf("too many attempts")
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashCode(id, code))) != 1 {
+		return fmt.Errorf("invalid code")
+	}
+	return nil
+}
+
+// randCode makes random numeric code with given number of digits
+func randCode(digits int) (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil))
+	if err != nil {
+		return "", fmt.Errorf("can't get random: %w", err)
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+func hashCode(id, code string) string {
+	h := sha256.Sum256([]byte(id + ":" + code))
+	return hex.EncodeToString(h[:])
+}
+
 // AuthHandler doesn't do anything for direct login as it has no callbacks
 func (e VerifyHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {}
 
@@ -210,6 +366,12 @@ Confirmation for {{.User}} {{.Address}}, site {{.Site}}
 Token: {{.Token}}
 `
 
+var codeMsgTemplate = `
+Confirmation for {{.User}} {{.Address}}, site {{.Site}}
+
+Code: {{.Code}}
+`
+
 func (e VerifyHandler) sanitize(inp string) string {
 	p := bluemonday.UGCPolicy()
 	res := p.Sanitize(inp)
@@ -0,0 +1,685 @@
+package provider
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/rest"
+	"github.com/golang-jwt/jwt"
+
+	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/mfa"
+	"github.com/efureev/sauth/token"
+)
+
+// webAuthnTimeout limits time of the ceremony, used as ttl of handshake token too
+const webAuthnTimeout = 5 * time.Minute
+
+// WebAuthnCookieName is a name of the cookie with handshake token of the ceremony, kept apart from the user's token
+const WebAuthnCookieName = "JWT-WEBAUTHN"
+
+// modes of registration kept in handshake id with the user, login has empty id
+const (
+	webAuthnSignUp = "signup::" // followed by name of the new user
+	webAuthnAdd    = "add::"    // followed by id of logged-in user adding passkey
+)
+
+// COSE algorithms supported for credentials
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+var b64url = base64.RawURLEncoding
+
+// WebAuthnHandler implements passwordless login with WebAuthn (passkeys) of platform and roaming authenticators.
+// Ceremony started by GET /login returning options for navigator.credentials.create or get,
+// the challenge kept in handshake token of own cookie, and finished by POST /callback with the credential.
+// With ConfirmationStore each challenge accepted once, otherwise the handshake token with captured credential can be
+// replayed till it expired by authenticators not supporting sign counter.
+type WebAuthnHandler struct {
+	logger.L
+	ProviderName    string
+	TokenService    WebAuthnTokenService
+	Issuer          string
+	AvatarSaver     AvatarSaver
+	CredentialStore CredentialStore
+	RPID            string // relying party id, domain of the site, i.e. example.com
+	RPName          string // relying party name shown by authenticators
+	Origin          string // origin of pages calling WebAuthn api, i.e. https://example.com
+	SecureCookies   bool   // send handshake cookie over https only
+
+	ConfirmationStore ConfirmationStore // optional store making challenges one-time
+	IdentityStore     IdentityStore     // optional store of identities linked to canonical users
+	SecondFactor      mfa.SecondFactor  // optional second factor, required for enrolled users after login
+}
+
+// WebAuthnTokenService defines interface accessing tokens, handshake token made with Token and set to own cookie
+type WebAuthnTokenService interface {
+	TokenService
+	Token(claims token.Claims) (string, error)
+	IsExpired(claims token.Claims) bool
+}
+
+// WebAuthnCredential is a public key credential registered by user's authenticator
+type WebAuthnCredential struct {
+	ID        []byte    `json:"id"`
+	UserID    string    `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	PublicKey []byte    `json:"public_key"` // COSE_Key encoded
+	SignCount uint32    `json:"sign_count"` // increased by authenticator on each assertion, if supported
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CredentialStore defines interface keeping WebAuthn credentials of users
+type CredentialStore interface {
+	// Get returns credential by id, empty credential if not found
+	Get(id []byte) (WebAuthnCredential, error)
+	// List returns credentials of the user
+	List(userID string) ([]WebAuthnCredential, error)
+	// Put adds credential or updates existing one with the same id, i.e. sign counter
+	Put(c WebAuthnCredential) error
+}
+
+// webAuthnResponse is PublicKeyCredential posted to /callback, all binary fields base64url encoded
+type webAuthnResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"` // registration only
+		AuthenticatorData string `json:"authenticatorData"` // assertion only
+		Signature         string `json:"signature"`         // assertion only
+		UserHandle        string `json:"userHandle"`        // assertion only, optional
+	} `json:"response"`
+}
+
+type webAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// authData is parsed authenticator data
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	credID    []byte // attested credential only
+	publicKey []byte // attested credential only, COSE_Key
+}
+
+// Name of the handler
+func (h WebAuthnHandler) Name() string { return h.ProviderName }
+
+// LoginHandler starts ceremony and returns options for navigator.credentials, binary fields base64url encoded.
+//
+// GET /login?site=site starts assertion (login), with `user=name` allowed credentials limited to the user's ones.
+//
+// GET /login?register=1&user=name&site=site starts registration of the passkey. Registration allowed for new user
+// without credentials, or for logged-in user adding one more passkey, `user` ignored in the latter case.
+func (h WebAuthnHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make challenge")
+		return
+	}
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make claim's id")
+		return
+	}
+
+	q := r.URL.Query()
+	claims := token.Claims{
+		Handshake:   &token.Handshake{State: b64url.EncodeToString(challenge)},
+		SessionOnly: q.Get("session") != "" && q.Get("session") != "0",
+		StandardClaims: jwt.StandardClaims{
+			Id:        cid,
+			Audience:  q.Get("site"),
+			ExpiresAt: time.Now().Add(webAuthnTimeout).Unix(),
+			NotBefore: time.Now().Add(-1 * time.Minute).Unix(),
+		},
+	}
+
+	var options interface{}
+	if q.Get("register") != "" && q.Get("register") != "0" {
+		u, loggedIn := h.currentUser(r)
+		if !loggedIn {
+			if q.Get("user") == "" {
+				rest.SendErrorJSON(w, r, h.L, http.StatusBadRequest, fmt.Errorf("no user"), "user name required")
+				return
+			}
+			u = token.User{Name: q.Get("user"), ID: h.userID(q.Get("user"))}
+		}
+		creds, err := h.CredentialStore.List(u.ID)
+		if err != nil {
+			rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to list credentials")
+			return
+		}
+		if !loggedIn && len(creds) > 0 {
+			rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, fmt.Errorf("user %s registered", u.ID),
+				"user registered already, login to add passkey")
+			return
+		}
+		// the user isn't verified till the ceremony finished, kept in handshake only
+		claims.Handshake.ID = webAuthnSignUp + u.Name
+		if loggedIn {
+			claims.Handshake.ID = webAuthnAdd + u.ID
+		}
+		options = h.creationOptions(challenge, u, creds)
+	} else {
+		var creds []WebAuthnCredential
+		if name := q.Get("user"); name != "" {
+			if creds, err = h.CredentialStore.List(h.userID(name)); err != nil {
+				rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to list credentials")
+				return
+			}
+		}
+		options = h.requestOptions(challenge, creds)
+	}
+
+	tkn, err := h.TokenService.Token(claims)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make handshake token")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: WebAuthnCookieName, Value: tkn, HttpOnly: true, Path: "/",
+		MaxAge: int(webAuthnTimeout.Seconds()), Secure: h.SecureCookies, SameSite: http.SameSiteStrictMode})
+	rest.RenderJSON(w, options)
+}
+
+// AuthHandler finishes ceremony started by LoginHandler and issues the token.
+// POST /callback with PublicKeyCredential json, binary fields base64url encoded.
+// Passkey added by logged-in user keeps the user's token as is.
+func (h WebAuthnHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	hsClaims, err := h.handshake(w, r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, err, "invalid handshake token")
+		return
+	}
+
+	// consumed before verification, so replayed or concurrent ceremony can't change credentials
+	if h.ConfirmationStore != nil {
+		if hsClaims.Id == "" {
+			rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, fmt.Errorf("no token id"), "failed to use challenge")
+			return
+		}
+		if err = h.ConfirmationStore.Use(hsClaims.Id, time.Unix(hsClaims.ExpiresAt, 0)); err != nil {
+			rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, err, "failed to use challenge")
+			return
+		}
+	}
+
+	var resp webAuthnResponse
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxHTTPBodySize)).Decode(&resp); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusBadRequest, err, "failed to parse credential")
+		return
+	}
+
+	var u token.User
+	addedByUser := strings.HasPrefix(hsClaims.Handshake.ID, webAuthnAdd)
+	switch {
+	case addedByUser:
+		current, loggedIn := h.currentUser(r)
+		if !loggedIn || webAuthnAdd+current.ID != hsClaims.Handshake.ID {
+			rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, fmt.Errorf("not logged in as %s",
+				strings.TrimPrefix(hsClaims.Handshake.ID, webAuthnAdd)), "user of the ceremony not logged in")
+			return
+		}
+		u, err = h.register(current, false, hsClaims.Handshake.State, resp)
+	case strings.HasPrefix(hsClaims.Handshake.ID, webAuthnSignUp):
+		name := strings.TrimPrefix(hsClaims.Handshake.ID, webAuthnSignUp)
+		u, err = h.register(token.User{Name: name, ID: h.userID(name)}, true, hsClaims.Handshake.State, resp)
+	default:
+		u, err = h.assert(hsClaims.Handshake.State, resp)
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusForbidden, err, "webauthn verification failed")
+		return
+	}
+	if addedByUser { // the user resolved and verified already
+		rest.RenderJSON(w, &u)
+		return
+	}
+
+	if u, err = resolveIdentity(w, r, h.IdentityStore, h.TokenService, h.ProviderName, u); err != nil {
+		rest.SendErrorJSON(w, r, h.L, identityErrorCode(err), err, "failed to resolve identity")
+		return
+	}
+
+	if u, err = setAvatar(h.AvatarSaver, u, &http.Client{Timeout: 5 * time.Second}); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to save avatar to proxy")
+		return
+	}
+
+	cid, err := randToken()
+	if err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to make claim's id")
+		return
+	}
+	claims := token.Claims{
+		User: &u,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   h.Issuer,
+			Id:       cid,
+			Audience: hsClaims.Audience,
+		},
+		SessionOnly: hsClaims.SessionOnly,
+	}
+	claims.SetAuth(token.AMRWebAuthn)
+	if err = requireSecondFactor(h.SecondFactor, &claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to check second factor")
+		return
+	}
+	if _, err = h.TokenService.Set(w, claims); err != nil {
+		rest.SendErrorJSON(w, r, h.L, http.StatusInternalServerError, err, "failed to set token")
+		return
+	}
+	rest.RenderJSON(w, &u)
+}
+
+// handshake returns claims of handshake token from the cookie and expires the cookie, the ceremony can't be repeated
+func (h WebAuthnHandler) handshake(w http.ResponseWriter, r *http.Request) (token.Claims, error) {
+	c, err := r.Cookie(WebAuthnCookieName)
+	if err != nil || c.Value == "" {
+		return token.Claims{}, fmt.Errorf("no handshake cookie")
+	}
+	http.SetCookie(w, &http.Cookie{Name: WebAuthnCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true,
+		Secure: h.SecureCookies, SameSite: http.SameSiteStrictMode})
+	claims, err := h.TokenService.Parse(c.Value)
+	if err != nil {
+		return token.Claims{}, err
+	}
+	if h.TokenService.IsExpired(claims) { // Parse allows expired tokens
+		return token.Claims{}, fmt.Errorf("handshake expired")
+	}
+	if claims.Handshake == nil || claims.Handshake.State == "" || claims.User != nil {
+		return token.Claims{}, fmt.Errorf("no handshake")
+	}
+	return claims, nil
+}
+
+// LogoutHandler - GET /logout
+func (h WebAuthnHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	h.TokenService.Reset(w)
+}
+
+// register verifies attestation of new credential and saves it for the user, new one in case of sign up
+func (h WebAuthnHandler) register(u token.User, signUp bool, challenge string, resp webAuthnResponse) (token.User, error) {
+	if _, err := h.checkClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return u, err
+	}
+
+	attObj, err := b64url.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return u, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	obj, _, err := cborDecode(attObj)
+	if err != nil {
+		return u, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	objMap, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return u, fmt.Errorf("invalid attestation object")
+	}
+	rawAuthData, ok := objMap["authData"].([]byte)
+	if !ok {
+		return u, fmt.Errorf("no authenticator data")
+	}
+	ad, err := h.parseAuthData(rawAuthData)
+	if err != nil {
+		return u, err
+	}
+	if ad.credID == nil {
+		return u, fmt.Errorf("no attested credential")
+	}
+	if _, _, err = cosePublicKey(ad.publicKey); err != nil {
+		return u, err
+	}
+
+	existing, err := h.CredentialStore.Get(ad.credID)
+	if err != nil {
+		return u, fmt.Errorf("can't get credential: %w", err)
+	}
+	if len(existing.ID) > 0 {
+		return u, fmt.Errorf("credential registered already")
+	}
+	if signUp { // user should have no credentials still
+		creds, err := h.CredentialStore.List(u.ID)
+		if err != nil {
+			return u, fmt.Errorf("can't list credentials: %w", err)
+		}
+		if len(creds) > 0 {
+			return u, fmt.Errorf("user %s registered already", u.ID)
+		}
+	}
+
+	cred := WebAuthnCredential{ID: ad.credID, UserID: u.ID, UserName: u.Name, PublicKey: ad.publicKey,
+		SignCount: ad.signCount, CreatedAt: time.Now()}
+	if err = h.CredentialStore.Put(cred); err != nil {
+		return u, fmt.Errorf("can't save credential: %w", err)
+	}
+	h.Logf("[INFO] webauthn credential registered for %s", u.ID)
+	return u, nil
+}
+
+// assert verifies signature of registered credential and its sign counter
+func (h WebAuthnHandler) assert(challenge string, resp webAuthnResponse) (token.User, error) {
+	rawClientData, err := h.checkClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return token.User{}, err
+	}
+
+	credID, err := b64url.DecodeString(resp.ID)
+	if err != nil || len(credID) == 0 {
+		return token.User{}, fmt.Errorf("invalid credential id")
+	}
+	cred, err := h.CredentialStore.Get(credID)
+	if err != nil {
+		return token.User{}, fmt.Errorf("can't get credential: %w", err)
+	}
+	if len(cred.ID) == 0 {
+		return token.User{}, fmt.Errorf("unknown credential")
+	}
+	if resp.Response.UserHandle != "" {
+		userHandle, err := b64url.DecodeString(resp.Response.UserHandle)
+		if err != nil || string(userHandle) != cred.UserID {
+			return token.User{}, fmt.Errorf("user handle mismatch")
+		}
+	}
+
+	rawAuthData, err := b64url.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return token.User{}, fmt.Errorf("invalid authenticator data: %w", err)
+	}
+	ad, err := h.parseAuthData(rawAuthData)
+	if err != nil {
+		return token.User{}, err
+	}
+	sig, err := b64url.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return token.User{}, fmt.Errorf("invalid signature: %w", err)
+	}
+	alg, key, err := cosePublicKey(cred.PublicKey)
+	if err != nil {
+		return token.User{}, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err = verifySignature(alg, key, append(rawAuthData, clientDataHash[:]...), sig); err != nil {
+		return token.User{}, err
+	}
+
+	if ad.signCount != 0 || cred.SignCount != 0 {
+		if ad.signCount <= cred.SignCount {
+			return token.User{}, fmt.Errorf("sign counter not increased, authenticator may be cloned")
+		}
+		cred.SignCount = ad.signCount
+		if err = h.CredentialStore.Put(cred); err != nil {
+			return token.User{}, fmt.Errorf("can't update credential: %w", err)
+		}
+	}
+	return token.User{ID: cred.UserID, Name: cred.UserName}, nil
+}
+
+// checkClientData verifies type, challenge and origin of client data, returns raw client data
+func (h WebAuthnHandler) checkClientData(encoded, typ, challenge string) ([]byte, error) {
+	raw, err := b64url.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err = json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+	if cd.Type != typ {
+		return nil, fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+	if cd.Challenge != challenge {
+		return nil, fmt.Errorf("challenge mismatch")
+	}
+	if cd.Origin != h.Origin {
+		return nil, fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return raw, nil
+}
+
+// parseAuthData parses authenticator data and checks rp id hash and user presence
+func (h WebAuthnHandler) parseAuthData(data []byte) (authData, error) {
+	if len(data) < 37 {
+		return authData{}, fmt.Errorf("authenticator data too short")
+	}
+	res := authData{rpIDHash: data[:32], flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	rpIDHash := sha256.Sum256([]byte(h.RPID))
+	if !bytes.Equal(res.rpIDHash, rpIDHash[:]) {
+		return authData{}, fmt.Errorf("rp id hash mismatch")
+	}
+	if res.flags&flagUserPresent == 0 {
+		return authData{}, fmt.Errorf("user not present")
+	}
+	if res.flags&flagAttestedData == 0 {
+		return res, nil
+	}
+
+	attested := data[37:]
+	if len(attested) < 18 { // aaguid and length of credential id
+		return authData{}, fmt.Errorf("invalid attested credential data")
+	}
+	idLen := int(binary.BigEndian.Uint16(attested[16:18]))
+	if len(attested) < 18+idLen {
+		return authData{}, fmt.Errorf("invalid credential id length")
+	}
+	res.credID = attested[18 : 18+idLen]
+	_, n, err := cborDecode(attested[18+idLen:])
+	if err != nil {
+		return authData{}, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	res.publicKey = attested[18+idLen : 18+idLen+n]
+	return res, nil
+}
+
+func (h WebAuthnHandler) creationOptions(challenge []byte, u token.User, creds []WebAuthnCredential) interface{} {
+	type rp struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	type user struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	type param struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	type selection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+	type options struct {
+		Challenge              string               `json:"challenge"`
+		RP                     rp                   `json:"rp"`
+		User                   user                 `json:"user"`
+		PubKeyCredParams       []param              `json:"pubKeyCredParams"`
+		Timeout                int64                `json:"timeout"`
+		Attestation            string               `json:"attestation"`
+		AuthenticatorSelection selection            `json:"authenticatorSelection"`
+		ExcludeCredentials     []webAuthnDescriptor `json:"excludeCredentials"`
+	}
+
+	res := options{
+		Challenge: b64url.EncodeToString(challenge),
+		RP:        rp{ID: h.RPID, Name: h.RPName},
+		User:      user{ID: b64url.EncodeToString([]byte(u.ID)), Name: u.Name, DisplayName: u.Name},
+		PubKeyCredParams: []param{{Type: "public-key", Alg: coseES256}, {Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256}},
+		Timeout:                webAuthnTimeout.Milliseconds(),
+		Attestation:            "none",
+		AuthenticatorSelection: selection{ResidentKey: "preferred", UserVerification: "preferred"},
+		ExcludeCredentials:     descriptors(creds),
+	}
+	return map[string]interface{}{"publicKey": res}
+}
+
+func (h WebAuthnHandler) requestOptions(challenge []byte, creds []WebAuthnCredential) interface{} {
+	type options struct {
+		Challenge        string               `json:"challenge"`
+		RPID             string               `json:"rpId"`
+		Timeout          int64                `json:"timeout"`
+		UserVerification string               `json:"userVerification"`
+		AllowCredentials []webAuthnDescriptor `json:"allowCredentials"`
+	}
+	res := options{
+		Challenge:        b64url.EncodeToString(challenge),
+		RPID:             h.RPID,
+		Timeout:          webAuthnTimeout.Milliseconds(),
+		UserVerification: "preferred",
+		AllowCredentials: descriptors(creds),
+	}
+	return map[string]interface{}{"publicKey": res}
+}
+
+// currentUser returns logged-in user, if full token presented
+func (h WebAuthnHandler) currentUser(r *http.Request) (token.User, bool) {
+	claims, _, err := h.TokenService.Get(r)
+	if err != nil || claims.User == nil || claims.Handshake != nil || claims.MFARequired {
+		return token.User{}, false
+	}
+	return *claims.User, true
+}
+
+func (h WebAuthnHandler) userID(name string) string {
+	return h.ProviderName + "_" + token.HashID(sha1.New(), name)
+}
+
+func descriptors(creds []WebAuthnCredential) []webAuthnDescriptor {
+	res := []webAuthnDescriptor{}
+	for _, c := range creds {
+		res = append(res, webAuthnDescriptor{Type: "public-key", ID: b64url.EncodeToString(c.ID)})
+	}
+	return res
+}
+
+// cosePublicKey parses COSE_Key (RFC 8152) of ES256, EdDSA or RS256 credential
+func cosePublicKey(data []byte) (alg int64, key crypto.PublicKey, err error) {
+	v, _, err := cborDecode(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid public key")
+	}
+	alg, _ = m[int64(3)].(int64)
+	kty, _ := m[int64(1)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	y, _ := m[int64(-3)].([]byte)
+
+	switch {
+	case alg == coseES256 && kty == 2 && crv == 1 && len(x) == 32 && len(y) == 32:
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, fmt.Errorf("invalid public key point")
+		}
+		return alg, pub, nil
+	case alg == coseEdDSA && kty == 1 && crv == 6 && len(x) == ed25519.PublicKeySize:
+		return alg, ed25519.PublicKey(x), nil
+	case alg == coseRS256 && kty == 3:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, fmt.Errorf("invalid rsa public key")
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported public key, alg %d, kty %d", alg, kty)
+}
+
+func verifySignature(alg int64, key crypto.PublicKey, data, sig []byte) error {
+	hash := sha256.Sum256(data)
+	var ok bool
+	switch alg {
+	case coseES256:
+		ok = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash[:], sig)
+	case coseEdDSA:
+		ok = ed25519.Verify(key.(ed25519.PublicKey), data, sig)
+	case coseRS256:
+		ok = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], sig) == nil
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// MemCredentialStore implements CredentialStore in memory, thread safe
+type MemCredentialStore struct {
+	lock  sync.Mutex
+	creds map[string]WebAuthnCredential // key is credential id
+}
+
+// NewMemCredentialStore makes in-memory credential store
+func NewMemCredentialStore() *MemCredentialStore {
+	return &MemCredentialStore{creds: map[string]WebAuthnCredential{}}
+}
+
+// Get returns credential by id
+func (m *MemCredentialStore) Get(id []byte) (WebAuthnCredential, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.creds[string(id)], nil
+}
+
+// List returns credentials of the user, oldest first
+func (m *MemCredentialStore) List(userID string) ([]WebAuthnCredential, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []WebAuthnCredential{}
+	for _, c := range m.creds {
+		if c.UserID == userID {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res, nil
+}
+
+// Put adds or updates credential
+func (m *MemCredentialStore) Put(c WebAuthnCredential) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.creds[string(c.ID)] = c
+	return nil
+}
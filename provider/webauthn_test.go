@@ -0,0 +1,318 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/efureev/sauth/logger"
+	"github.com/efureev/sauth/token"
+)
+
+func TestWebAuthn(t *testing.T) {
+	store := NewMemCredentialStore()
+	h := WebAuthnHandler{
+		L:            logger.Std,
+		ProviderName: "passkey",
+		TokenService: token.NewService(token.Opts{TokenDuration: time.Hour, DisableXSRF: true,
+			SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil })}),
+		Issuer:          "iss-test",
+		CredentialStore: store,
+		RPID:            "example.com",
+		RPName:          "Example",
+		Origin:          "https://example.com",
+	}
+	svc := NewService(h)
+	auth := newSoftAuthenticator(t, "example.com")
+
+	start := func(query string, cookie *http.Cookie) (int, map[string]interface{}, *http.Cookie) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/passkey/login?"+query, http.NoBody)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		svc.Handler(rr, req)
+		res := map[string]interface{}{}
+		_ = json.Unmarshal(rr.Body.Bytes(), &res)
+		if rr.Code != http.StatusOK {
+			return rr.Code, res, nil
+		}
+		opts := res["publicKey"].(map[string]interface{})
+		return rr.Code, opts, rr.Result().Cookies()[0]
+	}
+	finish := func(body string, cookies ...*http.Cookie) (int, token.Claims) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/passkey/callback", strings.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		svc.Handler(rr, req)
+		if rr.Code != http.StatusOK {
+			return rr.Code, token.Claims{}
+		}
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == "JWT" {
+				claims, err := h.TokenService.Parse(c.Value)
+				require.NoError(t, err)
+				return rr.Code, claims
+			}
+		}
+		return rr.Code, token.Claims{}
+	}
+
+	// sign up
+	code, opts, hs := start("register=1&user=alice&site=test", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "example.com", opts["rp"].(map[string]interface{})["id"])
+	assert.Equal(t, "alice", opts["user"].(map[string]interface{})["name"])
+	assert.Equal(t, WebAuthnCookieName, hs.Name, "handshake kept apart from user's token")
+	hsClaims, err := h.TokenService.Parse(hs.Value)
+	require.NoError(t, err)
+	assert.Nil(t, hsClaims.User, "user not verified yet")
+	code, claims := finish(auth.create(t, opts["challenge"].(string), "https://example.com"), hs)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "alice", claims.User.Name)
+	assert.Equal(t, h.userID("alice"), claims.User.ID)
+	assert.Equal(t, "test", claims.Audience)
+	assert.Nil(t, claims.Handshake)
+	creds, err := store.List(claims.User.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(creds))
+	code, _ = finish(auth.create(t, opts["challenge"].(string), "https://example.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "handshake cookie expired by the callback, not accepted again")
+
+	code, _, _ = start("register=1&user=alice", nil)
+	assert.Equal(t, http.StatusForbidden, code, "registered user can't sign up again")
+
+	// login with discoverable credential
+	code, opts, hs = start("site=test", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, len(opts["allowCredentials"].([]interface{})))
+	code, claims = finish(auth.get(t, opts["challenge"].(string), "https://example.com"), hs)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "alice", claims.User.Name)
+	assert.Equal(t, creds[0].UserID, claims.User.ID)
+
+	// login with user name
+	code, opts, hs = start("user=alice", nil)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(opts["allowCredentials"].([]interface{})))
+	assertion := auth.get(t, opts["challenge"].(string), "https://example.com")
+	code, _ = finish(assertion, hs)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = finish(assertion, hs)
+	assert.Equal(t, http.StatusForbidden, code, "sign counter not increased")
+
+	code, opts, hs = start("", nil)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = finish(auth.get(t, opts["challenge"].(string), "https://evil.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "wrong origin")
+	code, _ = finish(auth.get(t, "wrong-challenge", "https://example.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "wrong challenge")
+	other := newSoftAuthenticator(t, "example.com")
+	other.credID = auth.credID
+	code, _ = finish(other.get(t, opts["challenge"].(string), "https://example.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "wrong key")
+	evil := newSoftAuthenticator(t, "evil.com")
+	evil.credID, evil.key = auth.credID, auth.key
+	code, _ = finish(evil.get(t, opts["challenge"].(string), "https://example.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "wrong rp id")
+
+	// logged-in user adds passkey
+	tkn, err := h.TokenService.(*token.Service).Token(token.Claims{User: &token.User{ID: creds[0].UserID, Name: "alice",
+		Email: "alice@example.com"}, StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}})
+	require.NoError(t, err)
+	code, opts, hs = start("register=1", &http.Cookie{Name: "JWT", Value: tkn})
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, WebAuthnCookieName, hs.Name, "user's token not replaced by handshake")
+	assert.Equal(t, 1, len(opts["excludeCredentials"].([]interface{})))
+	second := newSoftAuthenticator(t, "example.com")
+	code, _ = finish(second.create(t, opts["challenge"].(string), "https://example.com"), hs)
+	assert.Equal(t, http.StatusForbidden, code, "user of the ceremony not logged in")
+	code, opts, hs = start("register=1", &http.Cookie{Name: "JWT", Value: tkn})
+	require.Equal(t, http.StatusOK, code)
+	code, claims = finish(second.create(t, opts["challenge"].(string), "https://example.com"), hs,
+		&http.Cookie{Name: "JWT", Value: tkn})
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, claims.User, "user's token kept as is")
+	creds, err = store.List(creds[0].UserID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(creds))
+
+	code, _ = finish(auth.get(t, "x", "https://example.com"), &http.Cookie{Name: "JWT", Value: tkn})
+	assert.Equal(t, http.StatusForbidden, code, "not a handshake token")
+}
+
+func TestWebAuthn_OneTimeChallenge(t *testing.T) {
+	h := WebAuthnHandler{
+		L:            logger.Std,
+		ProviderName: "passkey",
+		TokenService: token.NewService(token.Opts{TokenDuration: time.Hour, DisableXSRF: true,
+			SecretReader: token.SecretFunc(func(string) (string, error) { return "secret", nil })}),
+		CredentialStore:   NewMemCredentialStore(),
+		ConfirmationStore: NewMemConfirmationStore(),
+		RPID:              "example.com",
+		Origin:            "https://example.com",
+	}
+	svc := NewService(h)
+	auth := newSoftAuthenticator(t, "example.com")
+
+	start := func(query string) (challenge string, hs *http.Cookie) {
+		rr := httptest.NewRecorder()
+		svc.Handler(rr, httptest.NewRequest("GET", "/passkey/login?"+query, http.NoBody))
+		require.Equal(t, http.StatusOK, rr.Code)
+		res := map[string]map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		return res["publicKey"]["challenge"].(string), rr.Result().Cookies()[0]
+	}
+	finish := func(body string, cookie *http.Cookie) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/passkey/callback", strings.NewReader(body))
+		req.AddCookie(cookie)
+		svc.Handler(rr, req)
+		return rr.Code
+	}
+
+	challenge, hs := start("register=1&user=alice")
+	require.Equal(t, http.StatusOK, finish(auth.create(t, challenge, "https://example.com"), hs))
+
+	challenge, hs = start("")
+	assert.Equal(t, http.StatusForbidden, finish(auth.get(t, "wrong-challenge", "https://example.com"), hs))
+	assert.Equal(t, http.StatusForbidden, finish(auth.get(t, challenge, "https://example.com"), hs),
+		"challenge consumed by failed attempt")
+
+	challenge, hs = start("")
+	auth.counter = ^uint32(0) // wraps to zero by get, authenticator without sign counter
+	assertion := auth.get(t, challenge, "https://example.com")
+	assert.Equal(t, http.StatusOK, finish(assertion, hs))
+	assert.Equal(t, http.StatusForbidden, finish(assertion, hs), "replayed challenge")
+
+	// reused challenge rejected before the sign counter updated
+	challenge, hs = start("")
+	assert.Equal(t, http.StatusOK, finish(auth.get(t, challenge, "https://example.com"), hs))
+	assert.Equal(t, http.StatusForbidden, finish(auth.get(t, challenge, "https://example.com"), hs))
+	cred, err := h.CredentialStore.Get(auth.credID)
+	require.NoError(t, err)
+	assert.Equal(t, auth.counter-1, cred.SignCount, "credential not changed by reused challenge")
+}
+
+func TestCBORDecode(t *testing.T) {
+	v, n, err := cborDecode([]byte{0xa3, 0x01, 0x02, 0x20, 0x43, 1, 2, 3, 0x63, 'k', 'e', 'y', 0x82, 0xf5, 0x19, 0x01, 0x00, 0xff})
+	require.NoError(t, err)
+	assert.Equal(t, 17, n, "trailing data not consumed")
+	assert.Equal(t, map[interface{}]interface{}{int64(1): int64(2), int64(-1): []byte{1, 2, 3},
+		"key": []interface{}{true, int64(256)}}, v)
+
+	for _, data := range [][]byte{{}, {0x43, 1}, {0x9f}, {0xa1, 0x80, 0x01}, {0x85, 0x01}, {0xf9, 0, 0}} {
+		_, _, err = cborDecode(data)
+		assert.Error(t, err, "%x", data)
+	}
+}
+
+// softAuthenticator is a software WebAuthn authenticator with ES256 key
+type softAuthenticator struct {
+	rpID    string
+	key     *ecdsa.PrivateKey
+	credID  []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	credID := make([]byte, 16)
+	_, err = rand.Read(credID)
+	require.NoError(t, err)
+	return &softAuthenticator{rpID: rpID, key: key, credID: credID}
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	res := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(res[33:37], a.counter)
+	return append(res, attested...)
+}
+
+func (a *softAuthenticator) clientData(typ, challenge, origin string) []byte {
+	res, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	return res
+}
+
+func (a *softAuthenticator) create(t *testing.T, challenge, origin string) string {
+	pad := func(b []byte) []byte { return append(make([]byte, 32-len(b)), b...) }
+	cose := cborEncode(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: pad(a.key.X.Bytes()), -3: pad(a.key.Y.Bytes())})
+	attested := append(make([]byte, 16), byte(len(a.credID)>>8), byte(len(a.credID)))
+	attested = append(append(attested, a.credID...), cose...)
+	attObj := cborEncode(map[interface{}]interface{}{"fmt": "none", "attStmt": map[interface{}]interface{}{},
+		"authData": a.authData(flagUserPresent|flagAttestedData, attested)})
+
+	res, err := json.Marshal(map[string]interface{}{"id": b64url.EncodeToString(a.credID), "type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(a.clientData("webauthn.create", challenge, origin)),
+			"attestationObject": b64url.EncodeToString(attObj),
+		}})
+	require.NoError(t, err)
+	return string(res)
+}
+
+func (a *softAuthenticator) get(t *testing.T, challenge, origin string) string {
+	a.counter++
+	ad := a.authData(flagUserPresent|0x04, nil)
+	cd := a.clientData("webauthn.get", challenge, origin)
+	cdHash := sha256.Sum256(cd)
+	hash := sha256.Sum256(append(append([]byte{}, ad...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	require.NoError(t, err)
+
+	res, err := json.Marshal(map[string]interface{}{"id": b64url.EncodeToString(a.credID), "type": "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(cd),
+			"authenticatorData": b64url.EncodeToString(ad),
+			"signature":         b64url.EncodeToString(sig),
+		}})
+	require.NoError(t, err)
+	return string(res)
+}
+
+// cborEncode encodes ints, strings, byte strings and maps, enough for attestation object
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		}
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+	switch x := v.(type) {
+	case int:
+		if x < 0 {
+			return head(1, -1-x)
+		}
+		return head(0, x)
+	case string:
+		return append(head(3, len(x)), x...)
+	case []byte:
+		return append(head(2, len(x)), x...)
+	case map[interface{}]interface{}:
+		res := head(5, len(x))
+		for k, v := range x {
+			res = append(append(res, cborEncode(k)...), cborEncode(v)...)
+		}
+		return res
+	}
+	panic("unsupported type")
+}
@@ -0,0 +1,182 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Encrypter defines interface wrapping signed token to JWE (compact serialization) and unwrapping it back.
+// Used by Service to make nested signed-then-encrypted tokens, so claims are not readable outside the service.
+type Encrypter interface {
+	Encrypt(signed string) (string, error)
+	Decrypt(jwe string) (string, error)
+}
+
+// jweHeader is a protected header of JWE
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"` // "JWT" for nested token
+	Kid string `json:"kid,omitempty"`
+}
+
+const jweEncA256GCM = "A256GCM"
+
+// DirectEncrypter encrypts tokens with shared 256-bit key, "dir" key management and A256GCM content encryption
+type DirectEncrypter struct {
+	key []byte
+}
+
+// NewDirectEncrypter makes DirectEncrypter, key should be 32 bytes long
+func NewDirectEncrypter(key []byte) (*DirectEncrypter, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key size %d, A256GCM requires 32 bytes", len(key))
+	}
+	return &DirectEncrypter{key: key}, nil
+}
+
+// Encrypt makes JWE with empty encrypted key
+func (e *DirectEncrypter) Encrypt(signed string) (string, error) {
+	return jweSeal(jweHeader{Alg: "dir", Enc: jweEncA256GCM, Cty: "JWT"}, e.key, nil, signed)
+}
+
+// Decrypt opens JWE made by Encrypt
+func (e *DirectEncrypter) Decrypt(jwe string) (string, error) {
+	return jweOpen(jwe, func(h jweHeader, encKey []byte) ([]byte, error) {
+		if h.Alg != "dir" {
+			return nil, fmt.Errorf("unexpected key management algorithm %q", h.Alg)
+		}
+		if len(encKey) != 0 {
+			return nil, fmt.Errorf("unexpected encrypted key for direct encryption")
+		}
+		return e.key, nil
+	})
+}
+
+// RSAEncrypter encrypts tokens with random content key, wrapped with RSA-OAEP, and A256GCM content encryption
+type RSAEncrypter struct {
+	kid     string
+	private *rsa.PrivateKey
+}
+
+// NewRSAEncrypter makes RSAEncrypter, kid is optional and stamped to "kid" header
+func NewRSAEncrypter(kid string, private *rsa.PrivateKey) *RSAEncrypter {
+	return &RSAEncrypter{kid: kid, private: private}
+}
+
+// Encrypt makes JWE with content key encrypted by public part of the key
+func (e *RSAEncrypter) Encrypt(signed string) (string, error) {
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return "", fmt.Errorf("can't make content key: %w", err)
+	}
+	encKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &e.private.PublicKey, cek, nil)
+	if err != nil {
+		return "", fmt.Errorf("can't encrypt content key: %w", err)
+	}
+	return jweSeal(jweHeader{Alg: "RSA-OAEP", Enc: jweEncA256GCM, Cty: "JWT", Kid: e.kid}, cek, encKey, signed)
+}
+
+// Decrypt opens JWE made by Encrypt
+func (e *RSAEncrypter) Decrypt(jwe string) (string, error) {
+	return jweOpen(jwe, func(h jweHeader, encKey []byte) ([]byte, error) {
+		if h.Alg != "RSA-OAEP" {
+			return nil, fmt.Errorf("unexpected key management algorithm %q", h.Alg)
+		}
+		if h.Kid != e.kid {
+			return nil, fmt.Errorf("unexpected key id %q", h.Kid)
+		}
+		cek, err := rsa.DecryptOAEP(sha1.New(), nil, e.private, encKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt content key: %w", err)
+		}
+		return cek, nil
+	})
+}
+
+// isJWE checks if token is JWE compact serialization, it has five parts unlike three of JWS
+func isJWE(tokenString string) bool {
+	return strings.Count(tokenString, ".") == 4
+}
+
+// jweSeal encrypts payload with A256GCM and makes compact serialization, protected header used as aad
+func jweSeal(h jweHeader, cek, encKey []byte, payload string) (string, error) {
+	hdr, err := json.Marshal(h)
+	if err != nil {
+		return "", fmt.Errorf("can't marshal jwe header: %w", err)
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return "", fmt.Errorf("can't make iv: %w", err)
+	}
+
+	b64 := base64.RawURLEncoding
+	protected := b64.EncodeToString(hdr)
+	sealed := gcm.Seal(nil, iv, []byte(payload), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{protected, b64.EncodeToString(encKey), b64.EncodeToString(iv),
+		b64.EncodeToString(ciphertext), b64.EncodeToString(tag)}, "."), nil
+}
+
+// jweOpen parses compact serialization and decrypts payload with content key returned by cekFn
+func jweOpen(jwe string, cekFn func(h jweHeader, encKey []byte) ([]byte, error)) (string, error) {
+	parts := strings.Split(jwe, ".")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("invalid jwe, %d parts", len(parts))
+	}
+	b64 := base64.RawURLEncoding
+	raw := make([][]byte, 5)
+	for i, p := range parts {
+		var err error
+		if raw[i], err = b64.DecodeString(p); err != nil {
+			return "", fmt.Errorf("invalid jwe part %d: %w", i, err)
+		}
+	}
+
+	h := jweHeader{}
+	if err := json.Unmarshal(raw[0], &h); err != nil {
+		return "", fmt.Errorf("invalid jwe header: %w", err)
+	}
+	if h.Enc != jweEncA256GCM {
+		return "", fmt.Errorf("unexpected content encryption %q", h.Enc)
+	}
+	cek, err := cekFn(h, raw[1])
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	if len(raw[2]) != gcm.NonceSize() {
+		return "", fmt.Errorf("invalid iv size %d", len(raw[2]))
+	}
+	payload, err := gcm.Open(nil, raw[2], append(raw[3], raw[4]...), []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt jwe: %w", err)
+	}
+	return string(payload), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid content key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't make cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
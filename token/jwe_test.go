@@ -0,0 +1,86 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWE_Encrypters(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dirKey := make([]byte, 32)
+	_, err = rand.Read(dirKey)
+	require.NoError(t, err)
+	dir, err := NewDirectEncrypter(dirKey)
+	require.NoError(t, err)
+
+	for name, enc := range map[string]Encrypter{"dir": dir, "rsa": NewRSAEncrypter("k1", rsaKey)} {
+		t.Run(name, func(t *testing.T) {
+			jwe, err := enc.Encrypt(testJwtValid)
+			require.NoError(t, err)
+			assert.True(t, isJWE(jwe))
+			assert.NotContains(t, jwe, strings.Split(testJwtValid, ".")[1])
+
+			res, err := enc.Decrypt(jwe)
+			require.NoError(t, err)
+			assert.Equal(t, testJwtValid, res)
+
+			parts := strings.Split(jwe, ".")
+			tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+			require.NoError(t, err)
+			tag[0] ^= 1
+			parts[4] = base64.RawURLEncoding.EncodeToString(tag)
+			_, err = enc.Decrypt(strings.Join(parts, "."))
+			assert.Error(t, err, "tampered tag")
+
+			_, err = enc.Decrypt(testJwtValid)
+			assert.Error(t, err, "not jwe")
+		})
+	}
+
+	_, err = NewDirectEncrypter([]byte("short"))
+	assert.EqualError(t, err, "invalid key size 5, A256GCM requires 32 bytes")
+
+	jwe, err := dir.Encrypt(testJwtValid)
+	require.NoError(t, err)
+	_, err = NewRSAEncrypter("k1", rsaKey).Decrypt(jwe)
+	assert.EqualError(t, err, `unexpected key management algorithm "dir"`)
+}
+
+func TestJWT_Encrypted(t *testing.T) {
+	enc, err := NewDirectEncrypter([]byte("01234567890123456789012345678901"))
+	require.NoError(t, err)
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, Encrypter: enc})
+
+	claims := Claims{User: &User{ID: "id1", Name: "name1", Email: "me@example.com",
+		Attributes: map[string]interface{}{"tenant": "t1"}},
+		StandardClaims: jwt.StandardClaims{Id: "random id", Audience: "test_sys", Issuer: "remark42",
+			ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	tkn, err := j.Token(claims)
+	require.NoError(t, err)
+	assert.True(t, isJWE(tkn))
+
+	res, err := j.Parse(tkn)
+	require.NoError(t, err)
+	assert.Equal(t, "me@example.com", res.User.Email)
+	assert.Equal(t, "t1", res.User.Attributes["tenant"])
+
+	_, err = j.Parse(testJwtValid)
+	assert.EqualError(t, err, "can't parse token: not encrypted")
+
+	// signed token inside is verified
+	other := NewService(Opts{SecretReader: SecretFunc(func(string) (string, error) { return "other", nil }),
+		Encrypter: enc})
+	tkn, err = other.Token(claims)
+	require.NoError(t, err)
+	_, err = j.Parse(tkn)
+	assert.Error(t, err)
+}
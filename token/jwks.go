@@ -0,0 +1,143 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// JWKS is a JSON Web Key Set (RFC 7517) with public keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a public JSON Web Key. Only fields related to the key type are filled.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid,omitempty"`
+	Usage     string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	N string `json:"n,omitempty"` // RSA modulus
+	E string `json:"e,omitempty"` // RSA exponent
+
+	Curve string `json:"crv,omitempty"` // EC and OKP curve
+	X     string `json:"x,omitempty"`   // EC x coordinate or OKP public key
+	Y     string `json:"y,omitempty"`   // EC y coordinate
+}
+
+// JWK makes public JWK for the key, private part never exposed
+func (k Key) JWK() (JWK, error) {
+	res := JWK{ID: k.ID, Usage: "sig"}
+	if k.Method != nil {
+		res.Algorithm = k.Method.Alg()
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		res.KeyType = "RSA"
+		res.N = enc(pub.N.Bytes())
+		res.E = enc(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		res.KeyType = "EC"
+		res.Curve = pub.Curve.Params().Name
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		res.X = enc(pub.X.FillBytes(make([]byte, size)))
+		res.Y = enc(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		res.KeyType = "OKP"
+		res.Curve = "Ed25519"
+		res.X = enc(pub)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", k.Public)
+	}
+	return res, nil
+}
+
+// Key makes verification-only Key from JWK, reverse of Key.JWK.
+// Algorithm of JWK, if set, overrides the default signing method for the key type.
+func (k JWK) Key() (Key, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	var pub crypto.PublicKey
+	switch k.KeyType {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return Key{}, fmt.Errorf("can't decode modulus of %q: %w", k.ID, err)
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return Key{}, fmt.Errorf("can't decode exponent of %q: %w", k.ID, err)
+		}
+		pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return Key{}, fmt.Errorf("unsupported curve %q of %q", k.Curve, k.ID)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return Key{}, fmt.Errorf("can't decode x of %q: %w", k.ID, err)
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return Key{}, fmt.Errorf("can't decode y of %q: %w", k.ID, err)
+		}
+		pub = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return Key{}, fmt.Errorf("unsupported curve %q of %q", k.Curve, k.ID)
+		}
+		x, err := dec(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return Key{}, fmt.Errorf("invalid public key of %q", k.ID)
+		}
+		pub = ed25519.PublicKey(x)
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %q of %q", k.KeyType, k.ID)
+	}
+
+	res, err := NewPublicKey(k.ID, pub)
+	if err != nil {
+		return Key{}, err
+	}
+	if m := jwt.GetSigningMethod(k.Algorithm); m != nil {
+		res.Method = m
+	}
+	return res, nil
+}
+
+// JWKS returns public keys of KeySet, both active and retired
+func (j *Service) JWKS() (JWKS, error) {
+	if j.KeySet == nil {
+		return JWKS{}, fmt.Errorf("key set not defined")
+	}
+	keys, err := j.KeySet.Keys()
+	if err != nil {
+		return JWKS{}, fmt.Errorf("can't get keys: %w", err)
+	}
+	res := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, k := range keys {
+		jwk, err := k.JWK()
+		if err != nil {
+			return JWKS{}, fmt.Errorf("can't make jwk for %q: %w", k.ID, err)
+		}
+		res.Keys = append(res.Keys, jwk)
+	}
+	return res, nil
+}
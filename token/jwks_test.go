@@ -0,0 +1,115 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWKS_KeyJWK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	k, err := NewKey("rsa1", rsaKey)
+	require.NoError(t, err)
+	jwk, err := k.JWK()
+	require.NoError(t, err)
+	assert.Equal(t, "RSA", jwk.KeyType)
+	assert.Equal(t, "rsa1", jwk.ID)
+	assert.Equal(t, "RS256", jwk.Algorithm)
+	assert.Equal(t, "sig", jwk.Usage)
+	assert.Equal(t, "AQAB", jwk.E)
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	require.NoError(t, err)
+	assert.Equal(t, rsaKey.N, new(big.Int).SetBytes(n))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	k, err = NewKey("ec1", ecKey)
+	require.NoError(t, err)
+	jwk, err = k.JWK()
+	require.NoError(t, err)
+	assert.Equal(t, "EC", jwk.KeyType)
+	assert.Equal(t, "P-256", jwk.Curve)
+	assert.Equal(t, "ES256", jwk.Algorithm)
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	assert.Equal(t, 32, len(x))
+	assert.Equal(t, ecKey.X, new(big.Int).SetBytes(x))
+
+	edKey := mustEdKey(t)
+	k, err = NewKey("ed1", edKey)
+	require.NoError(t, err)
+	jwk, err = k.JWK()
+	require.NoError(t, err)
+	assert.Equal(t, JWK{KeyType: "OKP", ID: "ed1", Usage: "sig", Algorithm: "EdDSA", Curve: "Ed25519",
+		X: base64.RawURLEncoding.EncodeToString(edKey[32:])}, jwk)
+
+	_, err = Key{ID: "bad", Public: "blah"}.JWK()
+	assert.EqualError(t, err, "unsupported key type string")
+}
+
+func TestJWKS_Service(t *testing.T) {
+	_, err := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)}).JWKS()
+	assert.EqualError(t, err, "key set not defined")
+
+	k1, err := NewKey("k1", mustEdKey(t))
+	require.NoError(t, err)
+	k2, err := NewKey("k2", mustEdKey(t))
+	require.NoError(t, err)
+	ks := NewStaticKeySet(k1)
+	ks.Rotate(k2)
+
+	jwks, err := NewService(Opts{KeySet: ks}).JWKS()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(jwks.Keys))
+	assert.Equal(t, "k2", jwks.Keys[0].ID, "active key first")
+	assert.Equal(t, "k1", jwks.Keys[1].ID)
+
+	ks.Retire("k1")
+	jwks, err = NewService(Opts{KeySet: ks}).JWKS()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(jwks.Keys))
+	assert.Equal(t, "k2", jwks.Keys[0].ID)
+}
+
+func TestJWKS_JWKKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	for _, signer := range []crypto.Signer{rsaKey, ecKey, mustEdKey(t)} {
+		k, err := NewKey("k1", signer)
+		require.NoError(t, err)
+		jwk, err := k.JWK()
+		require.NoError(t, err)
+		res, err := jwk.Key()
+		require.NoError(t, err)
+		assert.Equal(t, "k1", res.ID)
+		assert.Equal(t, k.Method, res.Method)
+		assert.Equal(t, k.Public, res.Public)
+		assert.Nil(t, res.Private)
+	}
+
+	k, err := NewKey("k1", rsaKey)
+	require.NoError(t, err)
+	jwk, err := k.JWK()
+	require.NoError(t, err)
+	jwk.Algorithm = "PS256"
+	res, err := jwk.Key()
+	require.NoError(t, err)
+	assert.Equal(t, "PS256", res.Method.Alg(), "algorithm of jwk used")
+
+	_, err = JWK{KeyType: "oct", ID: "k2"}.Key()
+	assert.EqualError(t, err, `unsupported key type "oct" of "k2"`)
+	_, err = JWK{KeyType: "EC", Curve: "P-192", ID: "k3"}.Key()
+	assert.EqualError(t, err, `unsupported curve "P-192" of "k3"`)
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt"
+
+	"github.com/efureev/sauth/logger"
 )
 
 // Service wraps jwt operations
@@ -24,13 +26,23 @@ type Claims struct {
 	SessionOnly bool       `json:"sess_only,omitempty"`
 	Handshake   *Handshake `json:"handshake,omitempty"` // used for oauth handshake
 	NoAva       bool       `json:"no-ava,omitempty"`    // disable avatar, always use identicon
+	Scope       string     `json:"scope,omitempty"`     // space-separated granted scopes, see AddScopes
+	// first factor passed but second one not verified yet, the token isn't accepted by Authenticator
+	MFARequired bool `json:"mfa_required,omitempty"`
+	// time and methods of user's authentication, set on login by SetAuth and kept unchanged by refreshes
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	// application-defined claims, set with SetExtra (i.e. by ClaimsUpdater) and read with GetExtra
+	Extra json.RawMessage `json:"extra,omitempty"`
 }
 
 // Handshake used for oauth handshake
 type Handshake struct {
-	State string `json:"state,omitempty"`
-	From  string `json:"from,omitempty"`
-	ID    string `json:"id,omitempty"`
+	State    string `json:"state,omitempty"`
+	From     string `json:"from,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Verifier string `json:"verifier,omitempty"` // pkce code verifier
+	Nonce    string `json:"nonce,omitempty"`    // openid connect nonce
 }
 
 const (
@@ -47,13 +59,42 @@ const (
 	defaultCookieDuration = time.Hour * 24 * 31
 
 	defaultTokenQuery = "token"
+
+	// browsers limit cookie to 4096 bytes including name and attributes
+	cookieChunkSize = 3800
+	maxCookieChunks = 4
+	chunkedCookie   = "chunked" // value of plain cookie for token split to chunks
+
+	defaultRefreshCookieName = "JWT-REFRESH"
+	defaultRefreshHeaderKey  = "X-JWT-REFRESH"
 )
 
 var NeedToRegenerateTokenError = fmt.Errorf(`need to regenerate token`)
 
+// RevokedTokenError returned by Get for tokens with id (jti) revoked in RevocationStore
+var RevokedTokenError = fmt.Errorf(`token revoked`)
+
+// NoTokenError returned by Get if none of TokenSources has the token
+var NoTokenError = fmt.Errorf(`token was not presented`)
+
+// TokenSource defines a place of request Get looks for the token
+type TokenSource string
+
+// supported token sources
+const (
+	SourceQuery  TokenSource = "query"  // JWTQuery param of url
+	SourceHeader TokenSource = "header" // JWTHeaderKey header
+	SourceBearer TokenSource = "bearer" // Authorization header with Bearer scheme, RFC 6750
+	SourceCookie TokenSource = "cookie" // JWTCookieName cookie, requires XSRF header
+)
+
+// DefaultTokenSources used by Get if Opts.TokenSources not defined
+var DefaultTokenSources = []TokenSource{SourceQuery, SourceHeader, SourceBearer, SourceCookie}
+
 // Opts holds constructor params
 type Opts struct {
 	SecretReader   Secret
+	KeySet         KeySet // asymmetric keys, if defined used to sign tokens instead of SecretReader
 	ClaimsUpd      ClaimsUpdater
 	SecureCookies  bool
 	TokenDuration  time.Duration
@@ -67,11 +108,25 @@ type Opts struct {
 	XSRFCookieName  string
 	XSRFHeaderKey   string
 	JWTQuery        string
-	AudienceReader  Audience      // allowed aud values
-	Issuer          string        // optional value for iss claim, usually application name
-	AudSecrets      bool          // uses different secret for differed auds. important: adds pre-parsing of unverified token
-	SendJWTHeader   bool          // if enabled send JWT as a header instead of cookie
-	SameSite        http.SameSite // define a cookie attribute making it impossible for the browser to send this cookie cross-site
+	AudienceReader  Audience        // allowed aud values
+	Issuer          string          // optional value for iss claim, usually application name
+	AudSecrets      bool            // uses different secret for differed auds. important: adds pre-parsing of unverified token
+	SendJWTHeader   bool            // if enabled send JWT as a header instead of cookie
+	SameSite        http.SameSite   // define a cookie attribute making it impossible for the browser to send this cookie cross-site
+	RevocationStore RevocationStore // optional store of revoked token ids, checked on each Get
+	// optional refresh tokens, issued with each token if RefreshStore defined
+	RefreshStore      RefreshStore
+	RefreshDuration   time.Duration // refresh token's TTL, default CookieDuration
+	RefreshCookieName string
+	RefreshHeaderKey  string
+	SessionStore      SessionStore  // optional store of user's sessions, recorded by Set
+	Logger            logger.L      // optional logger, used for warnings
+	Leeway            time.Duration // tolerated clock skew for exp, nbf and iat, no tolerance by default
+	// optional encryption of signed tokens (nested JWE), only encrypted tokens accepted if defined
+	Encrypter Encrypter
+	// ordered list of places to look for the token, DefaultTokenSources if not defined.
+	// Query-string tokens can be disabled by the list without SourceQuery.
+	TokenSources []TokenSource
 }
 
 // NewService makes JWT service
@@ -91,6 +146,8 @@ func NewService(opts Opts) *Service {
 	setDefault(&res.JWTQuery, defaultTokenQuery)
 	setDefault(&res.Issuer, defaultIssuer)
 	setDefault(&res.JWTCookieDomain, defaultJWTCookieDomain)
+	setDefault(&res.RefreshCookieName, defaultRefreshCookieName)
+	setDefault(&res.RefreshHeaderKey, defaultRefreshHeaderKey)
 
 	if opts.TokenDuration == 0 {
 		res.TokenDuration = defaultTokenDuration
@@ -100,6 +157,14 @@ func NewService(opts Opts) *Service {
 		res.CookieDuration = defaultCookieDuration
 	}
 
+	if opts.RefreshDuration == 0 {
+		res.RefreshDuration = res.CookieDuration
+	}
+
+	if len(opts.TokenSources) == 0 {
+		res.TokenSources = DefaultTokenSources
+	}
+
 	return &res
 }
 
@@ -113,9 +178,7 @@ func (j *Service) Token(claims Claims) (string, error) {
 		claims = j.ClaimsUpd.Update(claims)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	if j.SecretReader == nil {
+	if j.SecretReader == nil && j.KeySet == nil {
 		return "", fmt.Errorf("secret reader not defined")
 	}
 
@@ -123,6 +186,27 @@ func (j *Service) Token(claims Claims) (string, error) {
 		return "", fmt.Errorf("aud rejected: %w", err)
 	}
 
+	tokenString, err := j.sign(claims)
+	if err != nil {
+		return "", err
+	}
+
+	if j.Encrypter != nil {
+		if tokenString, err = j.Encrypter.Encrypt(tokenString); err != nil {
+			return "", fmt.Errorf("can't encrypt token: %w", err)
+		}
+	}
+	return tokenString, nil
+}
+
+// sign makes signed token with KeySet if defined, with HS256 and secret from SecretReader otherwise
+func (j *Service) sign(claims Claims) (string, error) {
+	if j.KeySet != nil {
+		return j.signWithKeySet(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
 	secret, err := j.SecretReader.Get(claims.Audience) // get secret via consumer defined SecretReader
 	if err != nil {
 		return "", fmt.Errorf("can't get secret: %w", err)
@@ -135,12 +219,81 @@ func (j *Service) Token(claims Claims) (string, error) {
 	return tokenString, nil
 }
 
+// signWithKeySet signs token with active key of KeySet and stamps key id to "kid" header
+func (j *Service) signWithKeySet(claims Claims) (string, error) {
+	key, err := j.KeySet.Signing()
+	if err != nil {
+		return "", fmt.Errorf("can't get signing key: %w", err)
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	tokenString, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", fmt.Errorf("can't sign token: %w", err)
+	}
+	return tokenString, nil
+}
+
 // Parse token string and verify. Not checking for expiration
 func (j *Service) Parse(tokenString string) (Claims, error) {
 	parser := jwt.Parser{SkipClaimsValidation: true} // allow parsing of expired tokens
 
+	if j.Encrypter != nil {
+		if !isJWE(tokenString) {
+			return Claims{}, fmt.Errorf("can't parse token: not encrypted")
+		}
+		signed, err := j.Encrypter.Decrypt(tokenString)
+		if err != nil {
+			return Claims{}, fmt.Errorf("can't parse token: %w", err)
+		}
+		tokenString = signed
+	}
+
+	keyFunc, err := j.keyFunc(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	token, err := parser.ParseWithClaims(tokenString, &Claims{}, keyFunc)
+	if err != nil {
+		return Claims{}, fmt.Errorf("can't parse token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return Claims{}, fmt.Errorf("invalid token")
+	}
+
+	if err = j.checkAuds(claims, j.AudienceReader); err != nil {
+		return Claims{}, fmt.Errorf("aud rejected: %w", err)
+	}
+	return *claims, j.validate(claims)
+}
+
+// keyFunc makes jwt.Keyfunc for given token. Tokens signed with HMAC verified by secret from SecretReader,
+// all others by the key from KeySet matching token's kid. Accepting both allows migration from shared secret to key pairs.
+func (j *Service) keyFunc(tokenString string) (jwt.Keyfunc, error) {
+	if j.KeySet != nil && (j.SecretReader == nil || !isHMAC(tokenString)) {
+		return func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			kid, _ := token.Header["kid"].(string)
+			key, err := j.KeySet.Verification(kid)
+			if err != nil {
+				return nil, fmt.Errorf("can't get verification key: %w", err)
+			}
+			if key.Method.Alg() != token.Method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key.Public, nil
+		}, nil
+	}
+
 	if j.SecretReader == nil {
-		return Claims{}, fmt.Errorf("secret reader not defined")
+		return nil, fmt.Errorf("secret reader not defined")
 	}
 
 	aud := "ignore"
@@ -148,34 +301,32 @@ func (j *Service) Parse(tokenString string) (Claims, error) {
 		var err error
 		aud, err = j.aud(tokenString)
 		if err != nil {
-			return Claims{}, fmt.Errorf("can't retrieve audience from the token")
+			return nil, fmt.Errorf("can't retrieve audience from the token")
 		}
 	}
 
 	secret, err := j.SecretReader.Get(aud)
 	if err != nil {
-		return Claims{}, fmt.Errorf("can't get secret: %w", err)
+		return nil, fmt.Errorf("can't get secret: %w", err)
 	}
 
-	token, err := parser.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+	return func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(secret), nil
-	})
-	if err != nil {
-		return Claims{}, fmt.Errorf("can't parse token: %w", err)
-	}
-
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
-		return Claims{}, fmt.Errorf("invalid token")
-	}
+	}, nil
+}
 
-	if err = j.checkAuds(claims, j.AudienceReader); err != nil {
-		return Claims{}, fmt.Errorf("aud rejected: %w", err)
+// isHMAC checks signing method of unverified token
+func isHMAC(tokenString string) bool {
+	parser := jwt.Parser{}
+	token, _, err := parser.ParseUnverified(tokenString, &Claims{})
+	if err != nil {
+		return false
 	}
-	return *claims, j.validate(claims)
+	_, ok := token.Method.(*jwt.SigningMethodHMAC)
+	return ok
 }
 
 // aud pre-parse token and extracts aud from the claim
@@ -196,20 +347,16 @@ func (j *Service) aud(tokenString string) (string, error) {
 	return claims.Audience, nil
 }
 
+// validate checks nbf and iat with Leeway, expiration not checked to allow refresh of expired tokens
 func (j *Service) validate(claims *Claims) error {
-	cerr := claims.Valid()
-
-	if cerr == nil {
-		return nil
+	now := time.Now().Add(j.Leeway).Unix()
+	if !claims.VerifyNotBefore(now, false) {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
 	}
-
-	if e, ok := cerr.(*jwt.ValidationError); ok {
-		if e.Errors == jwt.ValidationErrorExpired {
-			return nil // allow expired tokens
-		}
+	if !claims.VerifyIssuedAt(now, false) {
+		return jwt.NewValidationError("Token used before issued", jwt.ValidationErrorIssuedAt)
 	}
-
-	return cerr
+	return nil
 }
 
 // Set creates token cookie with xsrf cookie and put it to ResponseWriter
@@ -232,6 +379,21 @@ func (j *Service) Set(w http.ResponseWriter, claims Claims) (Claims, error) {
 	if err != nil {
 		return Claims{}, fmt.Errorf("failed to make token token: %w", err)
 	}
+	if !j.SendJWTHeader && len(tokenString) > cookieChunkSize*maxCookieChunks {
+		return Claims{}, fmt.Errorf("token too large for cookies, %d bytes", len(tokenString))
+	}
+
+	if j.SessionStore != nil && claims.User != nil && claims.Handshake == nil && !claims.MFARequired {
+		if err = j.touchSession(claims); err != nil {
+			return Claims{}, fmt.Errorf("failed to record session: %w", err)
+		}
+	}
+
+	if j.RefreshStore != nil && claims.User != nil && claims.Handshake == nil && !claims.MFARequired {
+		if err = j.setRefreshToken(w, claims); err != nil {
+			return Claims{}, fmt.Errorf("failed to make refresh token: %w", err)
+		}
+	}
 
 	if j.SendJWTHeader {
 		w.Header().Set(j.JWTHeaderKey, tokenString)
@@ -239,13 +401,11 @@ func (j *Service) Set(w http.ResponseWriter, claims Claims) (Claims, error) {
 	}
 
 	cookieExpiration := 0 // session cookie
-	if !claims.SessionOnly && claims.Handshake == nil {
+	if !claims.SessionOnly && claims.Handshake == nil && !claims.MFARequired {
 		cookieExpiration = int(j.CookieDuration.Seconds())
 	}
 
-	jwtCookie := http.Cookie{Name: j.JWTCookieName, Value: tokenString, HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
-		MaxAge: cookieExpiration, Secure: j.SecureCookies, SameSite: j.SameSite}
-	http.SetCookie(w, &jwtCookie)
+	j.setTokenCookie(w, tokenString, cookieExpiration)
 
 	xsrfCookie := http.Cookie{Name: j.XSRFCookieName, Value: claims.Id, HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: cookieExpiration, Secure: j.SecureCookies, SameSite: j.SameSite}
@@ -254,38 +414,25 @@ func (j *Service) Set(w http.ResponseWriter, claims Claims) (Claims, error) {
 	return claims, nil
 }
 
-// Get token from url, header or cookie
+// Get token from the first of TokenSources having it (url, header, bearer or cookie)
 // if cookie used, verify xsrf token to match
 func (j *Service) Get(r *http.Request) (Claims, string, error) {
 
-	fromCookie := false
-	tokenString := ""
-
-	// try to get from "token" query param
-	if tkQuery := r.URL.Query().Get(j.JWTQuery); tkQuery != "" {
-		tokenString = tkQuery
-	}
-
-	// try to get from JWT header
-	if tokenHeader := r.Header.Get(j.JWTHeaderKey); tokenHeader != "" && tokenString == "" {
-		tokenString = tokenHeader
-	}
-
-	// try to get from JWT cookie
+	tokenString, src := j.lookup(r)
 	if tokenString == "" {
-		fromCookie = true
-		jc, err := r.Cookie(j.JWTCookieName)
-		if err != nil {
-			return Claims{}, "", fmt.Errorf("token cookie was not presented: %w", err)
-		}
-		tokenString = jc.Value
+		return Claims{}, "", NoTokenError
 	}
+	fromCookie := src == SourceCookie
 
 	claims, err := j.Parse(tokenString)
 	if err != nil {
 		return Claims{}, "", fmt.Errorf("failed to get token: %w", err)
 	}
 
+	if err = j.checkRevoked(claims); err != nil {
+		return Claims{}, "", err
+	}
+
 	// promote claim's aud to User.Audience
 	if claims.User != nil {
 		claims.User.Audience = claims.Audience
@@ -318,12 +465,229 @@ func (j *Service) Get(r *http.Request) (Claims, string, error) {
 	return claims, tokenString, err
 }
 
-// IsExpired returns true if claims expired
+// Check parses passed token and rejects revoked and expired ones.
+// Same checks as Get does, but without request, i.e. for the token passed by another service.
+func (j *Service) Check(tokenString string) (Claims, error) {
+	claims, err := j.Parse(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err = j.checkRevoked(claims); err != nil {
+		return Claims{}, err
+	}
+	if j.IsExpired(claims) {
+		return Claims{}, fmt.Errorf("token expired")
+	}
+	if claims.User != nil {
+		claims.User.Audience = claims.Audience
+	}
+	return claims, nil
+}
+
+// lookup returns the token from the first of TokenSources having it
+func (j *Service) lookup(r *http.Request) (string, TokenSource) {
+	sources := j.TokenSources
+	if len(sources) == 0 {
+		sources = DefaultTokenSources
+	}
+	for _, src := range sources {
+		tkn := ""
+		switch src {
+		case SourceQuery:
+			tkn = r.URL.Query().Get(j.JWTQuery)
+		case SourceHeader:
+			tkn = r.Header.Get(j.JWTHeaderKey)
+		case SourceBearer:
+			if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+				tkn = strings.TrimSpace(auth[7:])
+			}
+		case SourceCookie:
+			tkn = j.cookieToken(r)
+		}
+		if tkn != "" {
+			return tkn, src
+		}
+	}
+	return "", ""
+}
+
+// setTokenCookie sets token cookie. Token larger than cookieChunkSize split to JWT.0, JWT.1, ... cookies,
+// as browsers drop cookies over 4KB. Plain cookie set to "chunked" marker then, chunks used only with the marker,
+// so plain token or reset makes chunks of the previous token stale. See DropStaleChunks to expire them.
+func (j *Service) setTokenCookie(w http.ResponseWriter, tokenString string, maxAge int) {
+	if len(tokenString) <= cookieChunkSize {
+		http.SetCookie(w, j.tokenCookie(j.JWTCookieName, tokenString, maxAge))
+		return
+	}
+
+	chunks := (len(tokenString) + cookieChunkSize - 1) / cookieChunkSize
+	if j.Logger != nil {
+		j.Logger.Logf("[WARN] token size %d bytes exceeds cookie limit, split to %d cookies", len(tokenString), chunks)
+	}
+	http.SetCookie(w, j.tokenCookie(j.JWTCookieName, chunkedCookie, maxAge))
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * cookieChunkSize
+		if end > len(tokenString) {
+			end = len(tokenString)
+		}
+		http.SetCookie(w, j.tokenCookie(j.chunkName(i), tokenString[i*cookieChunkSize:end], maxAge))
+	}
+	if chunks < maxCookieChunks {
+		http.SetCookie(w, j.tokenCookie(j.chunkName(chunks), "", -1))
+	}
+}
+
+// cookieToken returns token from cookie, reassembled from chunks if plain cookie has "chunked" marker
+func (j *Service) cookieToken(r *http.Request) string {
+	jc, err := r.Cookie(j.JWTCookieName)
+	if err != nil {
+		return ""
+	}
+	if jc.Value != chunkedCookie {
+		return jc.Value
+	}
+	res := strings.Builder{}
+	for i := 0; i < maxCookieChunks; i++ {
+		jc, err := r.Cookie(j.chunkName(i))
+		if err != nil {
+			break
+		}
+		res.WriteString(jc.Value)
+	}
+	return res.String()
+}
+
+func (j *Service) tokenCookie(name, value string, maxAge int) *http.Cookie {
+	res := http.Cookie{Name: name, Value: value, HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
+		MaxAge: maxAge, Secure: j.SecureCookies, SameSite: j.SameSite}
+	if maxAge < 0 {
+		res.Expires = time.Unix(0, 0)
+	}
+	return &res
+}
+
+func (j *Service) chunkName(i int) string {
+	return fmt.Sprintf("%s.%d", j.JWTCookieName, i)
+}
+
+// DropStaleChunks middleware expires chunks of large token carried by the request if the response sets
+// plain token cookie, i.e. with smaller token. Only chunks presented in the request and not set by the response expired.
+func (j *Service) DropStaleChunks(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		var chunks []string
+		for i := 0; i < maxCookieChunks; i++ {
+			if _, err := r.Cookie(j.chunkName(i)); err == nil {
+				chunks = append(chunks, j.chunkName(i))
+			}
+		}
+		if len(chunks) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &chunksWriter{ResponseWriter: w, j: j, chunks: chunks}
+		next.ServeHTTP(cw, r)
+		cw.expire()
+	}
+	return http.HandlerFunc(fn)
+}
+
+// chunksWriter expires stale chunks right before the headers sent
+type chunksWriter struct {
+	http.ResponseWriter
+	j       *Service
+	chunks  []string
+	checked bool
+}
+
+func (c *chunksWriter) WriteHeader(code int) {
+	c.expire()
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *chunksWriter) Write(b []byte) (int, error) {
+	c.expire()
+	return c.ResponseWriter.Write(b)
+}
+
+// expire adds expired chunk cookies if plain token cookie set without "chunked" marker, once
+func (c *chunksWriter) expire() {
+	if c.checked {
+		return
+	}
+	c.checked = true
+	resp := http.Response{Header: http.Header{"Set-Cookie": c.Header()["Set-Cookie"]}}
+	plain, set := false, map[string]bool{}
+	for _, cookie := range resp.Cookies() {
+		set[cookie.Name] = true
+		if cookie.Name == c.j.JWTCookieName && cookie.Value != chunkedCookie {
+			plain = true
+		}
+	}
+	if !plain {
+		return
+	}
+	for _, name := range c.chunks {
+		if !set[name] { // expired by Reset already
+			http.SetCookie(c.ResponseWriter, c.j.tokenCookie(name, "", -1))
+		}
+	}
+}
+
+// Revoke adds token id (jti) to RevocationStore, drops refresh tokens of this token from RefreshStore
+// and marks the session revoked in SessionStore.
+// Expired token can be refreshed while the cookie alive, so revocation record kept for CookieDuration
+// after token's expiration.
+func (j *Service) Revoke(claims Claims) error {
+	if j.RevocationStore == nil && j.RefreshStore == nil && j.SessionStore == nil {
+		return nil
+	}
+	if claims.Id == "" {
+		return fmt.Errorf("can't revoke token without id")
+	}
+	if j.SessionStore != nil {
+		if err := j.SessionStore.Revoke(claims.Id); err != nil {
+			return fmt.Errorf("can't revoke session %s: %w", claims.Id, err)
+		}
+	}
+	if j.RefreshStore != nil {
+		if err := j.RefreshStore.RevokeFamily(claims.Id); err != nil {
+			return fmt.Errorf("can't revoke refresh tokens of %s: %w", claims.Id, err)
+		}
+	}
+	if j.RevocationStore == nil {
+		return nil
+	}
+	exp := time.Unix(claims.ExpiresAt, 0)
+	if latest := time.Now().Add(j.TokenDuration); exp.Before(latest) {
+		exp = latest // token could be refreshed before revocation
+	}
+	if err := j.RevocationStore.Revoke(claims.Id, exp.Add(j.CookieDuration)); err != nil {
+		return fmt.Errorf("can't revoke token %s: %w", claims.Id, err)
+	}
+	return nil
+}
+
+// checkRevoked rejects claims with id revoked in RevocationStore
+func (j *Service) checkRevoked(claims Claims) error {
+	if j.RevocationStore == nil || claims.Id == "" {
+		return nil
+	}
+	revoked, err := j.RevocationStore.IsRevoked(claims.Id)
+	if err != nil {
+		return fmt.Errorf("can't check token revocation: %w", err)
+	}
+	if revoked {
+		return RevokedTokenError
+	}
+	return nil
+}
+
+// IsExpired returns true if claims expired, tolerating Leeway
 func (j *Service) IsExpired(claims Claims) bool {
-	return !claims.VerifyExpiresAt(time.Now().Unix(), true)
+	return !claims.VerifyExpiresAt(time.Now().Add(-j.Leeway).Unix(), true)
 }
 
-// Reset token's cookies
+// Reset token's cookies, including chunks of large token
 func (j *Service) Reset(w http.ResponseWriter) {
 	jwtCookie := http.Cookie{Name: j.JWTCookieName, Value: "", HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: -1, Expires: time.Unix(0, 0), Secure: j.SecureCookies, SameSite: j.SameSite}
@@ -332,6 +696,16 @@ func (j *Service) Reset(w http.ResponseWriter) {
 	xsrfCookie := http.Cookie{Name: j.XSRFCookieName, Value: "", HttpOnly: false, Path: "/", Domain: j.JWTCookieDomain,
 		MaxAge: -1, Expires: time.Unix(0, 0), Secure: j.SecureCookies, SameSite: j.SameSite}
 	http.SetCookie(w, &xsrfCookie)
+
+	if j.RefreshStore != nil {
+		refreshCookie := http.Cookie{Name: j.RefreshCookieName, Value: "", HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
+			MaxAge: -1, Expires: time.Unix(0, 0), Secure: j.SecureCookies, SameSite: j.SameSite}
+		http.SetCookie(w, &refreshCookie)
+	}
+
+	for i := 0; i < maxCookieChunks; i++ {
+		http.SetCookie(w, j.tokenCookie(j.chunkName(i), "", -1))
+	}
 }
 
 // checkAuds verifies if claims.Audience in the list of allowed by audReader
@@ -351,6 +725,93 @@ func (j *Service) checkAuds(claims *Claims, audReader Audience) error {
 	return fmt.Errorf("aud %q not allowed", claims.Audience)
 }
 
+// AddScopes grants scopes, i.e. by ClaimsUpdater. Scopes already granted ignored.
+func (c *Claims) AddScopes(scopes ...string) {
+	res := c.Scopes()
+	for _, s := range scopes {
+		if s != "" && !c.HasScope(s) {
+			res = append(res, s)
+			c.Scope = strings.Join(res, " ")
+		}
+	}
+}
+
+// Scopes returns granted scopes
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasScope checks if scope granted
+func (c Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NoExtraError returned by GetExtra for claims without application-defined part
+var NoExtraError = fmt.Errorf(`no extra claims`)
+
+// authentication methods recorded to amr claim by providers, oauth ones recorded as AMROAuth(provider)
+const (
+	AMRPassword  = "password"
+	AMREmailLink = "email-link"
+	AMRTelegram  = "telegram"
+	AMRWebAuthn  = "webauthn"
+	AMROTP       = "otp"
+	AMRBasic     = "basic"
+)
+
+// AMROAuth makes authentication method of oauth provider, i.e. "oauth/github"
+func AMROAuth(provider string) string {
+	return "oauth/" + provider
+}
+
+// SetAuth records authentication of the user with methods at current time
+func (c *Claims) SetAuth(methods ...string) {
+	c.AuthTime = time.Now().Unix()
+	c.AMR = methods
+}
+
+// HasAMR checks if user authenticated with any of methods
+func (c Claims) HasAMR(methods ...string) bool {
+	for _, m := range methods {
+		for _, amr := range c.AMR {
+			if amr == m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetExtra sets application-defined claims, v marshaled to json
+func (c *Claims) SetExtra(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("can't marshal extra claims: %w", err)
+	}
+	c.Extra = data
+	return nil
+}
+
+// GetExtra unmarshals application-defined claims to v, v should be a pointer to the type passed to SetExtra
+func (c Claims) GetExtra(v interface{}) error {
+	return unmarshalExtra(c.Extra, v)
+}
+
+func unmarshalExtra(extra json.RawMessage, v interface{}) error {
+	if len(extra) == 0 {
+		return NoExtraError
+	}
+	if err := json.Unmarshal(extra, v); err != nil {
+		return fmt.Errorf("can't unmarshal extra claims: %w", err)
+	}
+	return nil
+}
+
 func (c Claims) String() string {
 	b, err := json.Marshal(c)
 	if err != nil {
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,6 +12,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/efureev/sauth/logger"
 )
 
 var (
@@ -375,11 +378,56 @@ func TestJWT_GetFromQuery(t *testing.T) {
 	assert.True(t, strings.Contains(err.Error(), "failed to get token: can't parse token: token contains an invalid number of segments"), err.Error())
 }
 
+func TestJWT_GetFromBearer(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31})
+
+	req := httptest.NewRequest("GET", "/blah", nil)
+	req.Header.Add("Authorization", "Bearer "+testJwtValid)
+	claims, tkn, err := j.Get(req)
+	require.NoError(t, err)
+	assert.Equal(t, testJwtValid, tkn)
+	assert.Equal(t, "id1", claims.User.ID)
+
+	req = httptest.NewRequest("GET", "/blah", nil)
+	req.Header.Add("Authorization", "bearer "+testJwtExpired)
+	_, _, err = j.Get(req)
+	assert.EqualError(t, err, "token expired")
+
+	req = httptest.NewRequest("GET", "/blah", nil)
+	req.Header.Add("Authorization", "Basic dXNlcjpwYXNzd2Q=")
+	_, _, err = j.Get(req)
+	assert.Equal(t, NoTokenError, err)
+}
+
+func TestJWT_GetTokenSources(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		TokenSources: []TokenSource{SourceBearer, SourceHeader}})
+
+	// query disabled
+	req := httptest.NewRequest("GET", "/blah?token="+testJwtValid, nil)
+	_, _, err := j.Get(req)
+	assert.Equal(t, NoTokenError, err)
+
+	// bearer goes first
+	req = httptest.NewRequest("GET", "/blah", nil)
+	req.Header.Add("Authorization", "Bearer "+testJwtValid)
+	req.Header.Add("X-JWT", testJwtExpired)
+	_, tkn, err := j.Get(req)
+	require.NoError(t, err)
+	assert.Equal(t, testJwtValid, tkn)
+
+	req = httptest.NewRequest("GET", "/blah", nil)
+	req.Header.Add("X-JWT", testJwtValid)
+	_, tkn, err = j.Get(req)
+	require.NoError(t, err)
+	assert.Equal(t, testJwtValid, tkn)
+}
+
 func TestJWT_GetFailed(t *testing.T) {
 	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), SecureCookies: false})
 	req := httptest.NewRequest("GET", "/", nil)
 	_, _, err := j.Get(req)
-	assert.Error(t, err, "token cookie was not presented")
+	assert.Equal(t, NoTokenError, err)
 }
 
 func TestJWT_SetAndGetWithCookies(t *testing.T) {
@@ -530,6 +578,142 @@ func TestJWT_Reset(t *testing.T) {
 	assert.Equal(t, "0", resp.Header.Get("Content-Length"))
 }
 
+func TestJWT_Leeway(t *testing.T) {
+	makeToken := func(j *Service, upd func(c *Claims)) string {
+		claims := Claims{User: &User{ID: "id1", Name: "name1"}, StandardClaims: jwt.StandardClaims{Id: "id",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(), IssuedAt: time.Now().Unix()}}
+		upd(&claims)
+		tkn, err := j.Token(claims)
+		require.NoError(t, err)
+		return tkn
+	}
+	skewed := []struct {
+		name string
+		upd  func(c *Claims)
+	}{
+		{"expired", func(c *Claims) { c.ExpiresAt = time.Now().Add(-10 * time.Second).Unix() }},
+		{"not valid yet", func(c *Claims) { c.NotBefore = time.Now().Add(10 * time.Second).Unix() }},
+		{"issued in future", func(c *Claims) { c.IssuedAt = time.Now().Add(10 * time.Second).Unix() }},
+	}
+
+	strict := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)})
+	tolerant := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), Leeway: 30 * time.Second})
+	for _, tt := range skewed {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Add("Authorization", "Bearer "+makeToken(strict, tt.upd))
+			_, _, err := strict.Get(req)
+			assert.Error(t, err)
+
+			req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Add("Authorization", "Bearer "+makeToken(tolerant, tt.upd))
+			claims, _, err := tolerant.Get(req)
+			require.NoError(t, err)
+			assert.False(t, tolerant.IsExpired(claims))
+		})
+	}
+
+	claims, err := tolerant.Parse(makeToken(tolerant, func(c *Claims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() }))
+	require.NoError(t, err)
+	assert.True(t, tolerant.IsExpired(claims), "expired beyond leeway")
+	_, err = tolerant.Parse(makeToken(tolerant, func(c *Claims) { c.NotBefore = time.Now().Add(time.Minute).Unix() }))
+	assert.EqualError(t, err, "token is not valid yet")
+}
+
+func TestJWT_SetAndGetChunked(t *testing.T) {
+	var warns []string
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour, CookieDuration: days31,
+		Logger: logger.Func(func(format string, args ...interface{}) { warns = append(warns, fmt.Sprintf(format, args...)) }),
+	})
+
+	claims := testClaims
+	claims.Handshake = nil
+	claims.User = &User{ID: "id1", Name: "name1", Attributes: map[string]interface{}{"big": strings.Repeat("x", 5000)}}
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, claims)
+	require.NoError(t, err)
+
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 5, len(cookies))
+	assert.Equal(t, "JWT", cookies[0].Name)
+	assert.Equal(t, "chunked", cookies[0].Value, "plain cookie with marker")
+	assert.Equal(t, "JWT.0", cookies[1].Name)
+	assert.Equal(t, 3800, len(cookies[1].Value))
+	assert.Equal(t, "JWT.1", cookies[2].Name)
+	assert.Equal(t, 31*24*3600, cookies[2].MaxAge)
+	assert.Equal(t, "JWT.2", cookies[3].Name)
+	assert.Equal(t, -1, cookies[3].MaxAge, "stale chunk expired")
+	assert.Equal(t, "XSRF-TOKEN", cookies[4].Name)
+	require.Equal(t, 1, len(warns))
+	assert.Contains(t, warns[0], "split to 2 cookies")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	req.AddCookie(cookies[1])
+	req.AddCookie(cookies[2])
+	req.Header.Add("X-XSRF-TOKEN", claims.Id)
+	res, tkn, err := j.Get(req)
+	require.NoError(t, err)
+	assert.Equal(t, cookies[1].Value+cookies[2].Value, tkn)
+	assert.Equal(t, claims.User.Attributes["big"], res.User.Attributes["big"])
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	req.AddCookie(cookies[2])
+	_, _, err = j.Get(req)
+	assert.Equal(t, NoTokenError, err, "first chunk missing")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[1])
+	req.AddCookie(cookies[2])
+	_, _, err = j.Get(req)
+	assert.Equal(t, NoTokenError, err, "stale chunks without marker ignored")
+
+	// small token replaces chunked one
+	small := testClaims
+	small.Handshake = nil
+	small.User = &User{ID: "id1", Name: "name1"}
+	handler := j.DropStaleChunks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, e := j.Set(w, small)
+		require.NoError(t, e)
+	}))
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies[:3] {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	cookies = rr.Result().Cookies()
+	require.Equal(t, 4, len(cookies), "jwt, xsrf and expired chunks of the request")
+	assert.NotEqual(t, "chunked", cookies[0].Value)
+	assert.Equal(t, "JWT.0", cookies[2].Name)
+	assert.Equal(t, -1, cookies[2].MaxAge)
+	assert.Equal(t, "JWT.1", cookies[3].Name)
+	assert.Equal(t, -1, cookies[3].MaxAge)
+
+	handler = j.DropStaleChunks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, e := j.Set(w, claims)
+		require.NoError(t, e)
+	}))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, 5, len(rr.Result().Cookies()), "chunks of the new token kept")
+
+	handler = j.DropStaleChunks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { j.Reset(w) }))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	cookies = rr.Result().Cookies()
+	require.Equal(t, 6, len(cookies), "jwt, xsrf and all chunks expired by reset, not duplicated")
+	for i, c := range cookies[2:] {
+		assert.Equal(t, fmt.Sprintf("JWT.%d", i), c.Name)
+		assert.Equal(t, -1, c.MaxAge)
+	}
+
+	claims.User.Attributes["big"] = strings.Repeat("x", 20000)
+	_, err = j.Set(httptest.NewRecorder(), claims)
+	assert.Error(t, err, "too large")
+}
+
 func TestJWT_Validator(t *testing.T) {
 	ch := ValidatorFunc(func(token string, claims Claims) bool {
 		return token == "good"
@@ -538,6 +722,57 @@ func TestJWT_Validator(t *testing.T) {
 	assert.False(t, ch.Validate("bad", Claims{}))
 }
 
+func TestClaims_Extra(t *testing.T) {
+	type appClaims struct {
+		TenantID string   `json:"tenant_id"`
+		Plans    []string `json:"plans"`
+	}
+
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), TokenDuration: time.Hour,
+		ClaimsUpd: ClaimsUpdFunc(func(claims Claims) Claims {
+			require.NoError(t, claims.SetExtra(appClaims{TenantID: "t1", Plans: []string{"pro"}}))
+			return claims
+		}),
+	})
+
+	claims := testClaims
+	claims.Handshake = nil
+	assert.Equal(t, NoExtraError, claims.GetExtra(&appClaims{}))
+
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, claims)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	req.Header.Add("X-XSRF-TOKEN", claims.Id)
+	res, tkn, err := j.Get(req)
+	require.NoError(t, err)
+	extra := appClaims{}
+	require.NoError(t, res.GetExtra(&extra))
+	assert.Equal(t, appClaims{TenantID: "t1", Plans: []string{"pro"}}, extra)
+
+	validator := ValidatorFunc(func(_ string, claims Claims) bool {
+		c := appClaims{}
+		return claims.GetExtra(&c) == nil && c.TenantID == "t1"
+	})
+	assert.True(t, validator.Validate(tkn, res))
+
+	assert.Error(t, res.GetExtra(&[]string{}), "wrong type")
+	assert.Error(t, claims.SetExtra(func() {}), "can't marshal")
+}
+
+func TestClaims_Scopes(t *testing.T) {
+	c := Claims{}
+	assert.Empty(t, c.Scopes())
+	c.AddScopes("comments:read", "", "comments:write", "comments:read")
+	assert.Equal(t, "comments:read comments:write", c.Scope)
+	c.AddScopes("users:read")
+	assert.Equal(t, []string{"comments:read", "comments:write", "users:read"}, c.Scopes())
+	assert.True(t, c.HasScope("comments:write"))
+	assert.False(t, c.HasScope("comments"))
+}
+
 func TestClaims_String(t *testing.T) {
 	s := testClaims.String()
 	assert.True(t, strings.Contains(s, `"aud":"test_sys"`))
@@ -0,0 +1,165 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// KeySet defines interface returning asymmetric keys used to sign and verify tokens.
+// Tokens signed with the key from KeySet carry its ID in the "kid" header, and verification key picked by this kid.
+type KeySet interface {
+	Signing() (Key, error)                // active key used to sign new tokens
+	Verification(kid string) (Key, error) // active or retired key for given kid
+	Keys() ([]Key, error)                 // all keys allowed for verification, active first
+}
+
+// Key is a single key of the KeySet
+type Key struct {
+	ID      string            // key id, stamped to "kid" header of signed tokens
+	Method  jwt.SigningMethod // signing method, i.e. RS256, ES256 or EdDSA
+	Private crypto.PrivateKey // private key, empty for verification-only keys
+	Public  crypto.PublicKey  // public key used to verify tokens
+}
+
+// NewKey makes signing Key for RSA, ECDSA or Ed25519 private key. Signing method defined by the type of the key,
+// RS256 for RSA, ES256/ES384/ES512 for ECDSA (depends on curve) and EdDSA for Ed25519
+func NewKey(kid string, private crypto.Signer) (Key, error) {
+	method, err := signingMethod(private.Public())
+	if err != nil {
+		return Key{}, err
+	}
+	if k, ok := private.(*ed25519.PrivateKey); ok { // jwt expects ed25519 key by value
+		private = *k
+	}
+	return Key{ID: kid, Method: method, Private: private, Public: private.Public()}, nil
+}
+
+// NewPublicKey makes verification-only Key, can be used for retired keys or keys of other issuers
+func NewPublicKey(kid string, public crypto.PublicKey) (Key, error) {
+	method, err := signingMethod(public)
+	if err != nil {
+		return Key{}, err
+	}
+	if k, ok := public.(*ed25519.PublicKey); ok {
+		public = *k
+	}
+	return Key{ID: kid, Method: method, Public: public}, nil
+}
+
+// NewKeyFromPEM makes signing Key from PEM encoded RSA, ECDSA or Ed25519 private key
+func NewKeyFromPEM(kid string, data []byte) (Key, error) {
+	if k, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return NewKey(kid, k)
+	}
+	if k, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		return NewKey(kid, k)
+	}
+	k, err := jwt.ParseEdPrivateKeyFromPEM(data)
+	if err != nil {
+		return Key{}, fmt.Errorf("can't parse private key %s: unsupported or invalid pem", kid)
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return Key{}, fmt.Errorf("can't parse private key %s: not a signer", kid)
+	}
+	return NewKey(kid, signer)
+}
+
+// signingMethod returns jwt signing method for given public key
+func signingMethod(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported ecdsa curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey, *ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", public)
+}
+
+// StaticKeySet is a thread-safe in-memory KeySet with one active key and any number of retired keys.
+// Retired keys used for verification only, allowing to rotate keys without invalidation of issued tokens.
+type StaticKeySet struct {
+	lock    sync.RWMutex
+	active  Key
+	retired []Key
+}
+
+// NewStaticKeySet makes StaticKeySet with active key used for signing and optional retired keys
+func NewStaticKeySet(active Key, retired ...Key) *StaticKeySet {
+	return &StaticKeySet{active: active, retired: retired}
+}
+
+// Signing returns active key
+func (s *StaticKeySet) Signing() (Key, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.active.Private == nil {
+		return Key{}, fmt.Errorf("no private part for active key %q", s.active.ID)
+	}
+	return s.active, nil
+}
+
+// Verification returns active or retired key by kid
+func (s *StaticKeySet) Verification(kid string) (Key, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.active.ID == kid {
+		return s.active, nil
+	}
+	for _, k := range s.retired {
+		if k.ID == kid {
+			return k, nil
+		}
+	}
+	return Key{}, fmt.Errorf("key %q not found", kid)
+}
+
+// Keys returns active and retired keys
+func (s *StaticKeySet) Keys() ([]Key, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	res := make([]Key, 0, len(s.retired)+1)
+	res = append(res, s.active)
+	return append(res, s.retired...), nil
+}
+
+// Rotate makes key active and moves previously active key to retired.
+// Retired key keeps verifying tokens signed before rotation until removed with Retire.
+func (s *StaticKeySet) Rotate(key Key) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.active
+	prev.Private = nil // retired keys never sign
+	s.retired = append([]Key{prev}, s.retired...)
+	s.active = key
+}
+
+// Retire removes retired key by kid, tokens signed with this key will be rejected
+func (s *StaticKeySet) Retire(kid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]Key, 0, len(s.retired))
+	for _, k := range s.retired {
+		if k.ID != kid {
+			res = append(res, k)
+		}
+	}
+	s.retired = res
+}
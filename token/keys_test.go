@@ -0,0 +1,190 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys_NewKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	k, err := NewKey("rsa1", rsaKey)
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", k.Method.Alg())
+	assert.Equal(t, "rsa1", k.ID)
+	assert.Equal(t, &rsaKey.PublicKey, k.Public)
+
+	for curve, alg := range map[elliptic.Curve]string{elliptic.P256(): "ES256", elliptic.P384(): "ES384",
+		elliptic.P521(): "ES512"} {
+		ecKey, e := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, e)
+		k, e = NewKey("ec1", ecKey)
+		require.NoError(t, e)
+		assert.Equal(t, alg, k.Method.Alg())
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	k, err = NewKey("ed1", edKey)
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", k.Method.Alg())
+
+	k, err = NewPublicKey("ed1", edKey.Public())
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", k.Method.Alg())
+	assert.Nil(t, k.Private)
+
+	_, err = NewPublicKey("bad", "not a key")
+	assert.EqualError(t, err, "unsupported key type string")
+}
+
+func TestKeys_NewKeyFromPEM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	k, err := NewKeyFromPEM("ec1", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	assert.Equal(t, "ES256", k.Method.Alg())
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err = x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	k, err = NewKeyFromPEM("ed1", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", k.Method.Alg())
+
+	_, err = NewKeyFromPEM("bad", []byte("bad pem"))
+	assert.EqualError(t, err, "can't parse private key bad: unsupported or invalid pem")
+}
+
+func TestKeys_TokenAndParse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for _, signer := range []crypto.Signer{rsaKey, ecKey, edKey} {
+		key, e := NewKey("k1", signer)
+		require.NoError(t, e)
+		j := NewService(Opts{KeySet: NewStaticKeySet(key)})
+
+		tkn, e := j.Token(keysTestClaims())
+		require.NoError(t, e)
+
+		parsed, _, e := new(jwt.Parser).ParseUnverified(tkn, &Claims{})
+		require.NoError(t, e)
+		assert.Equal(t, "k1", parsed.Header["kid"])
+		assert.Equal(t, key.Method.Alg(), parsed.Header["alg"])
+
+		claims, e := j.Parse(tkn)
+		require.NoError(t, e, key.Method.Alg())
+		assert.Equal(t, "id1", claims.User.ID)
+	}
+}
+
+func TestKeys_Rotate(t *testing.T) {
+	k1, err := NewKey("k1", mustEdKey(t))
+	require.NoError(t, err)
+	k2, err := NewKey("k2", mustEdKey(t))
+	require.NoError(t, err)
+
+	ks := NewStaticKeySet(k1)
+	j := NewService(Opts{KeySet: ks})
+
+	tkn1, err := j.Token(keysTestClaims())
+	require.NoError(t, err)
+
+	ks.Rotate(k2)
+	tkn2, err := j.Token(keysTestClaims())
+	require.NoError(t, err)
+
+	_, err = j.Parse(tkn1)
+	assert.NoError(t, err, "token signed with retired key still valid")
+	_, err = j.Parse(tkn2)
+	assert.NoError(t, err)
+
+	retired, err := ks.Verification("k1")
+	require.NoError(t, err)
+	assert.Nil(t, retired.Private, "retired key has no private part")
+
+	ks.Retire("k1")
+	_, err = j.Parse(tkn1)
+	assert.EqualError(t, err, `can't parse token: can't get verification key: key "k1" not found`)
+	_, err = j.Parse(tkn2)
+	assert.NoError(t, err)
+
+	ks = NewStaticKeySet(Key{ID: "pub", Method: k1.Method, Public: k1.Public})
+	_, err = NewService(Opts{KeySet: ks}).Token(keysTestClaims())
+	assert.EqualError(t, err, `can't get signing key: no private part for active key "pub"`)
+}
+
+func TestKeys_ParseRejects(t *testing.T) {
+	k1, err := NewKey("k1", mustEdKey(t))
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	k2, err := NewKey("k1", ecKey) // same kid, different alg
+	require.NoError(t, err)
+
+	tkn, err := NewService(Opts{KeySet: NewStaticKeySet(k2)}).Token(keysTestClaims())
+	require.NoError(t, err)
+
+	j := NewService(Opts{KeySet: NewStaticKeySet(k1)})
+	_, err = j.Parse(tkn)
+	assert.EqualError(t, err, "can't parse token: unexpected signing method: ES256")
+
+	// hmac token can't be verified without secret reader
+	hmacTkn, err := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)}).Token(keysTestClaims())
+	require.NoError(t, err)
+	_, err = j.Parse(hmacTkn)
+	assert.EqualError(t, err, "can't parse token: unexpected signing method: HS256")
+}
+
+func TestKeys_MigrationFromSecret(t *testing.T) {
+	k1, err := NewKey("k1", mustEdKey(t))
+	require.NoError(t, err)
+
+	hmacTkn, err := NewService(Opts{SecretReader: SecretFunc(mockKeyStore)}).Token(keysTestClaims())
+	require.NoError(t, err)
+
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), KeySet: NewStaticKeySet(k1)})
+	_, err = j.Parse(hmacTkn)
+	assert.NoError(t, err, "old hmac token accepted")
+
+	tkn, err := j.Token(keysTestClaims())
+	require.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(tkn, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", parsed.Header["alg"], "new tokens signed with key set")
+	_, err = j.Parse(tkn)
+	assert.NoError(t, err)
+}
+
+func mustEdKey(t *testing.T) ed25519.PrivateKey {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return k
+}
+
+func keysTestClaims() Claims {
+	return Claims{
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix(), Id: "random id"},
+		User:           &User{ID: "id1", Name: "name1"},
+	}
+}
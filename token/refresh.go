@@ -0,0 +1,172 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RefreshTokenReusedError returned by RefreshStore.Use for the refresh token used already.
+// It indicates stolen token, the whole family should be revoked.
+var RefreshTokenReusedError = fmt.Errorf(`refresh token reused`)
+
+// RefreshToken is a server-side record of opaque refresh token. The token itself never stored, only its hash.
+// All tokens rotated from the same login share a family equal to the id (jti) of the access token.
+type RefreshToken struct {
+	ID        string    `json:"id"`     // sha256 of the token
+	Family    string    `json:"family"` // id (jti) of the access token
+	Claims    Claims    `json:"claims"` // claims to issue access token with
+	ExpiresAt time.Time `json:"exp"`
+	Used      bool      `json:"used"`
+}
+
+// RefreshStore defines interface keeping refresh tokens
+type RefreshStore interface {
+	Put(rt RefreshToken) error
+	// Use marks token used and returns it. For the token used before returns it with RefreshTokenReusedError
+	Use(id string) (RefreshToken, error)
+	RevokeFamily(family string) error
+}
+
+// Refresh issues new access and refresh tokens for the refresh token presented in the request and puts them
+// to ResponseWriter the same way as Set. Each refresh token can be used once, reuse revokes the whole family.
+func (j *Service) Refresh(w http.ResponseWriter, r *http.Request) (Claims, error) {
+	if j.RefreshStore == nil {
+		return Claims{}, fmt.Errorf("refresh store not defined")
+	}
+
+	tkn := j.refreshTokenFromRequest(r)
+	if tkn == "" {
+		return Claims{}, fmt.Errorf("refresh token was not presented")
+	}
+
+	rt, err := j.RefreshStore.Use(hashRefreshToken(tkn))
+	if err == RefreshTokenReusedError {
+		if e := j.Revoke(rt.Claims); e != nil {
+			return Claims{}, fmt.Errorf("can't revoke family %s of reused refresh token: %w", rt.Family, e)
+		}
+		return Claims{}, RefreshTokenReusedError
+	}
+	if err != nil {
+		return Claims{}, fmt.Errorf("can't use refresh token: %w", err)
+	}
+
+	if time.Now().After(rt.ExpiresAt) {
+		return Claims{}, fmt.Errorf("refresh token expired")
+	}
+
+	claims := rt.Claims
+	claims.ExpiresAt = 0 // this will cause now+duration for refreshed token
+	return j.Set(w, claims)
+}
+
+// setRefreshToken makes new refresh token for claims, saves it to RefreshStore and puts to ResponseWriter
+func (j *Service) setRefreshToken(w http.ResponseWriter, claims Claims) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("can't get random: %w", err)
+	}
+	tkn := hex.EncodeToString(b)
+
+	rt := RefreshToken{
+		ID:        hashRefreshToken(tkn),
+		Family:    claims.Id,
+		Claims:    claims,
+		ExpiresAt: time.Now().Add(j.RefreshDuration),
+	}
+	if err := j.RefreshStore.Put(rt); err != nil {
+		return fmt.Errorf("can't save refresh token: %w", err)
+	}
+
+	if j.SendJWTHeader {
+		w.Header().Set(j.RefreshHeaderKey, tkn)
+		return nil
+	}
+
+	cookieExpiration := 0 // session cookie
+	if !claims.SessionOnly {
+		cookieExpiration = int(j.RefreshDuration.Seconds())
+	}
+	refreshCookie := http.Cookie{Name: j.RefreshCookieName, Value: tkn, HttpOnly: true, Path: "/", Domain: j.JWTCookieDomain,
+		MaxAge: cookieExpiration, Secure: j.SecureCookies, SameSite: j.SameSite}
+	http.SetCookie(w, &refreshCookie)
+	return nil
+}
+
+// refreshTokenFromRequest gets refresh token from header, cookie or "refresh_token" form value
+func (j *Service) refreshTokenFromRequest(r *http.Request) string {
+	if tkn := r.Header.Get(j.RefreshHeaderKey); tkn != "" {
+		return tkn
+	}
+	if c, err := r.Cookie(j.RefreshCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.PostFormValue("refresh_token")
+}
+
+func hashRefreshToken(tkn string) string {
+	h := sha256.Sum256([]byte(tkn))
+	return hex.EncodeToString(h[:])
+}
+
+// MemRefreshStore implements RefreshStore in memory, thread safe.
+// Expired tokens removed on Put calls, but not more often than once per minute.
+type MemRefreshStore struct {
+	lock        sync.Mutex
+	tokens      map[string]RefreshToken
+	lastCleanup time.Time
+}
+
+// NewMemRefreshStore makes in-memory refresh store
+func NewMemRefreshStore() *MemRefreshStore {
+	return &MemRefreshStore{tokens: map[string]RefreshToken{}, lastCleanup: time.Now()}
+}
+
+// Put saves refresh token
+func (m *MemRefreshStore) Put(rt RefreshToken) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tokens[rt.ID] = rt
+	if time.Since(m.lastCleanup) > time.Minute {
+		now := time.Now()
+		for id, t := range m.tokens {
+			if now.After(t.ExpiresAt) {
+				delete(m.tokens, id)
+			}
+		}
+		m.lastCleanup = now
+	}
+	return nil
+}
+
+// Use marks refresh token used and returns it
+func (m *MemRefreshStore) Use(id string) (RefreshToken, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rt, ok := m.tokens[id]
+	if !ok {
+		return RefreshToken{}, fmt.Errorf("refresh token not found")
+	}
+	if rt.Used {
+		return rt, RefreshTokenReusedError
+	}
+	rt.Used = true
+	m.tokens[id] = rt
+	return rt, nil
+}
+
+// RevokeFamily removes all refresh tokens of the family
+func (m *MemRefreshStore) RevokeFamily(family string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, t := range m.tokens {
+		if t.Family == family {
+			delete(m.tokens, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package token
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefresh_SetAndRefresh(t *testing.T) {
+	store := NewMemRefreshStore()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RefreshStore: store, TokenDuration: time.Minute})
+
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, keysTestClaims())
+	require.NoError(t, err)
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 3, len(cookies))
+	assert.Equal(t, "JWT-REFRESH", cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, int(defaultCookieDuration.Seconds()), cookies[0].MaxAge)
+	refresh1 := cookies[0]
+	assert.Equal(t, 1, len(store.tokens))
+	assert.Equal(t, "random id", store.tokens[hashRefreshToken(refresh1.Value)].Family)
+
+	// refresh with cookie
+	req := httptest.NewRequest("POST", "/refresh", http.NoBody)
+	req.AddCookie(refresh1)
+	rr = httptest.NewRecorder()
+	claims, err := j.Refresh(rr, req)
+	require.NoError(t, err)
+	assert.Equal(t, "random id", claims.Id, "family kept")
+	assert.Equal(t, "id1", claims.User.ID)
+	assert.True(t, claims.ExpiresAt > time.Now().Unix())
+	cookies = rr.Result().Cookies()
+	require.Equal(t, 3, len(cookies))
+	refresh2 := cookies[0]
+	assert.NotEqual(t, refresh1.Value, refresh2.Value, "refresh token rotated")
+
+	// refresh with form value
+	req = httptest.NewRequest("POST", "/refresh", strings.NewReader("refresh_token="+refresh2.Value))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	_, err = j.Refresh(rr, req)
+	require.NoError(t, err)
+	refresh3 := rr.Result().Cookies()[0]
+
+	// reuse of refresh2 kills the family
+	req = httptest.NewRequest("POST", "/refresh", http.NoBody)
+	req.AddCookie(refresh2)
+	_, err = j.Refresh(httptest.NewRecorder(), req)
+	assert.Equal(t, RefreshTokenReusedError, err)
+	assert.Equal(t, 0, len(store.tokens), "family revoked")
+
+	req = httptest.NewRequest("POST", "/refresh", http.NoBody)
+	req.AddCookie(refresh3)
+	_, err = j.Refresh(httptest.NewRecorder(), req)
+	assert.EqualError(t, err, "can't use refresh token: refresh token not found")
+
+	_, err = j.Refresh(httptest.NewRecorder(), httptest.NewRequest("POST", "/refresh", http.NoBody))
+	assert.EqualError(t, err, "refresh token was not presented")
+}
+
+func TestRefresh_Header(t *testing.T) {
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RefreshStore: NewMemRefreshStore(),
+		SendJWTHeader: true})
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, keysTestClaims())
+	require.NoError(t, err)
+	refresh := rr.Header().Get("X-JWT-REFRESH")
+	require.NotEmpty(t, refresh)
+	assert.Equal(t, 0, len(rr.Result().Cookies()))
+
+	req := httptest.NewRequest("POST", "/refresh", http.NoBody)
+	req.Header.Set("X-JWT-REFRESH", refresh)
+	rr = httptest.NewRecorder()
+	_, err = j.Refresh(rr, req)
+	require.NoError(t, err)
+	assert.NotEmpty(t, rr.Header().Get("X-JWT"))
+	assert.NotEqual(t, refresh, rr.Header().Get("X-JWT-REFRESH"))
+}
+
+func TestRefresh_NotIssued(t *testing.T) {
+	store := NewMemRefreshStore()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RefreshStore: store})
+
+	claims := keysTestClaims()
+	claims.User = nil
+	claims.Handshake = &Handshake{State: "123"}
+	rr := httptest.NewRecorder()
+	_, err := j.Set(rr, claims)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(rr.Result().Cookies()), "no refresh token for handshake")
+	assert.Equal(t, 0, len(store.tokens))
+
+	_, err = NewService(Opts{}).Refresh(httptest.NewRecorder(), httptest.NewRequest("POST", "/", http.NoBody))
+	assert.EqualError(t, err, "refresh store not defined")
+}
+
+func TestRefresh_Expired(t *testing.T) {
+	store := NewMemRefreshStore()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RefreshStore: store})
+	require.NoError(t, store.Put(RefreshToken{ID: hashRefreshToken("tkn"), Family: "f1",
+		ExpiresAt: time.Now().Add(-time.Second)}))
+
+	req := httptest.NewRequest("POST", "/refresh", http.NoBody)
+	req.Header.Set("X-JWT-REFRESH", "tkn")
+	_, err := j.Refresh(httptest.NewRecorder(), req)
+	assert.EqualError(t, err, "refresh token expired")
+}
+
+func TestRefresh_RevokeAndReset(t *testing.T) {
+	store := NewMemRefreshStore()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RefreshStore: store})
+	rr := httptest.NewRecorder()
+	claims, err := j.Set(rr, keysTestClaims())
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(store.tokens))
+
+	require.NoError(t, j.Revoke(claims))
+	assert.Equal(t, 0, len(store.tokens))
+
+	rr = httptest.NewRecorder()
+	j.Reset(rr)
+	cookies := rr.Result().Cookies()
+	require.Equal(t, 7, len(cookies)) // jwt, xsrf, refresh and 4 jwt chunks
+	assert.Equal(t, "JWT-REFRESH", cookies[2].Name)
+	assert.Equal(t, -1, cookies[2].MaxAge)
+}
@@ -0,0 +1,62 @@
+package token
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore defines interface keeping revoked token ids (jti) till the token can't be used anymore.
+// Implementation may drop records after keepUntil.
+type RevocationStore interface {
+	Revoke(id string, keepUntil time.Time) error
+	IsRevoked(id string) (bool, error)
+}
+
+// MemRevocationStore implements RevocationStore in memory, thread safe.
+// Expired records removed on Revoke calls, but not more often than once per minute.
+type MemRevocationStore struct {
+	lock        sync.Mutex
+	ids         map[string]time.Time
+	lastCleanup time.Time
+}
+
+// NewMemRevocationStore makes in-memory revocation store
+func NewMemRevocationStore() *MemRevocationStore {
+	return &MemRevocationStore{ids: map[string]time.Time{}, lastCleanup: time.Now()}
+}
+
+// Revoke adds token id to the store
+func (m *MemRevocationStore) Revoke(id string, keepUntil time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ids[id] = keepUntil
+	if time.Since(m.lastCleanup) > time.Minute {
+		m.cleanup()
+	}
+	return nil
+}
+
+// IsRevoked checks if token id in the store and not expired yet
+func (m *MemRevocationStore) IsRevoked(id string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keepUntil, ok := m.ids[id]
+	return ok && time.Now().Before(keepUntil), nil
+}
+
+// Cleanup removes expired records
+func (m *MemRevocationStore) Cleanup() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cleanup()
+}
+
+func (m *MemRevocationStore) cleanup() {
+	now := time.Now()
+	for id, keepUntil := range m.ids {
+		if now.After(keepUntil) {
+			delete(m.ids, id)
+		}
+	}
+	m.lastCleanup = now
+}
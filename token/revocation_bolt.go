@@ -0,0 +1,117 @@
+package token
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltRevocationStore implements RevocationStore with bolt
+// using separate db (file) with "revoked" bucket. Token id used as a key and keepUntil (RFC3339) as a value.
+// Expired records removed on Revoke calls, but not more often than once per minute.
+type BoltRevocationStore struct {
+	fileName string // full path to boltdb
+	db       *bolt.DB
+
+	lock        sync.Mutex
+	lastCleanup time.Time
+}
+
+const revokedBktName = "revoked"
+
+// NewBoltRevocationStore makes bolt revocation store
+func NewBoltRevocationStore(fileName string, options bolt.Options) (*BoltRevocationStore, error) {
+	db, err := bolt.Open(fileName, 0600, &options) //nolint
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make boltdb for %s", fileName)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, e := tx.CreateBucketIfNotExists([]byte(revokedBktName))
+		return errors.Wrapf(e, "failed to create top level bucket %s", revokedBktName)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize boltdb db %q buckets", fileName)
+	}
+	return &BoltRevocationStore{db: db, fileName: fileName, lastCleanup: time.Now()}, nil
+}
+
+// Revoke puts token id to bolt and removes expired records if the last cleanup was more than a minute ago
+func (b *BoltRevocationStore) Revoke(id string, keepUntil time.Time) error {
+	b.lock.Lock()
+	sweep := time.Since(b.lastCleanup) > time.Minute
+	if sweep {
+		b.lastCleanup = time.Now()
+	}
+	b.lock.Unlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(revokedBktName))
+		if err := bkt.Put([]byte(id), []byte(keepUntil.Format(time.RFC3339))); err != nil {
+			return errors.Wrapf(err, "can't put to bucket with %s", id)
+		}
+		if !sweep {
+			return nil
+		}
+		return b.cleanup(bkt)
+	})
+}
+
+// IsRevoked checks if token id in bolt and not expired yet
+func (b *BoltRevocationStore) IsRevoked(id string) (revoked bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(revokedBktName)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		keepUntil, e := time.Parse(time.RFC3339, string(data))
+		if e != nil {
+			return errors.Wrapf(e, "can't parse revocation time for %s", id)
+		}
+		revoked = time.Now().Before(keepUntil)
+		return nil
+	})
+	return revoked, err
+}
+
+// Cleanup removes expired records
+func (b *BoltRevocationStore) Cleanup() error {
+	b.lock.Lock()
+	b.lastCleanup = time.Now()
+	b.lock.Unlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.cleanup(tx.Bucket([]byte(revokedBktName)))
+	})
+}
+
+func (b *BoltRevocationStore) cleanup(bkt *bolt.Bucket) error {
+	var expired [][]byte
+	err := bkt.ForEach(func(k, v []byte) error {
+		keepUntil, e := time.Parse(time.RFC3339, string(v))
+		if e != nil || time.Now().After(keepUntil) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't iterate revoked tokens")
+	}
+	for _, k := range expired {
+		if err = bkt.Delete(k); err != nil {
+			return errors.Wrapf(err, "can't delete revoked token %s", string(k))
+		}
+	}
+	return nil
+}
+
+// Close bolt store
+func (b *BoltRevocationStore) Close() error {
+	return errors.Wrapf(b.db.Close(), "failed to close %s", b.fileName)
+}
+
+func (b *BoltRevocationStore) String() string {
+	return fmt.Sprintf("boltdb, path=%s", b.fileName)
+}
@@ -0,0 +1,99 @@
+package token
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRevocation_Mem(t *testing.T) {
+	s := NewMemRevocationStore()
+	testRevocationStore(t, s)
+	s.Cleanup()
+	assert.Equal(t, 1, len(s.ids), "expired record removed")
+}
+
+func TestRevocation_Bolt(t *testing.T) {
+	fileName := "/tmp/test-sauth-revoked.db"
+	_ = os.Remove(fileName)
+	s, err := NewBoltRevocationStore(fileName, bolt.Options{})
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, s.Close())
+		_ = os.Remove(fileName)
+	}()
+	assert.Equal(t, "boltdb, path=/tmp/test-sauth-revoked.db", s.String())
+
+	testRevocationStore(t, s)
+
+	require.NoError(t, s.Cleanup())
+	count := 0
+	err = s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket([]byte(revokedBktName)).Stats().KeyN
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "expired record removed")
+
+	// expired records swept on revoke without explicit Cleanup
+	require.NoError(t, s.Revoke("id4", time.Now().Add(-time.Second)))
+	require.NoError(t, s.Revoke("id5", time.Now().Add(time.Hour)))
+	s.lastCleanup = time.Now().Add(-2 * time.Minute)
+	require.NoError(t, s.Revoke("id6", time.Now().Add(time.Hour)))
+	err = s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket([]byte(revokedBktName)).Stats().KeyN
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count, "expired record removed on revoke")
+}
+
+func testRevocationStore(t *testing.T, s RevocationStore) {
+	require.NoError(t, s.Revoke("id1", time.Now().Add(time.Hour)))
+	require.NoError(t, s.Revoke("id2", time.Now().Add(-time.Second)))
+
+	revoked, err := s.IsRevoked("id1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = s.IsRevoked("id2")
+	require.NoError(t, err)
+	assert.False(t, revoked, "expired record ignored")
+
+	revoked, err = s.IsRevoked("id3")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func TestRevocation_ServiceGet(t *testing.T) {
+	store := NewMemRevocationStore()
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), RevocationStore: store, DisableXSRF: true,
+		TokenDuration: time.Hour, CookieDuration: days31})
+
+	claims := keysTestClaims()
+	tkn, err := j.Token(claims)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.Header.Add(defaultJWTHeaderKey, tkn)
+	_, _, err = j.Get(req)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Revoke(claims))
+	_, _, err = j.Get(req)
+	assert.Equal(t, RevokedTokenError, err)
+
+	keepUntil := store.ids[claims.Id]
+	assert.True(t, keepUntil.After(time.Now().Add(days31)), "kept till refreshable cookie expired")
+
+	claims.Id = ""
+	assert.EqualError(t, j.Revoke(claims), "can't revoke token without id")
+
+	assert.NoError(t, NewService(Opts{}).Revoke(claims), "no store, nothing to revoke")
+}
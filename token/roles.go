@@ -0,0 +1,92 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RoleTable defines role hierarchy and permissions granted to roles, i.e. loaded from config.
+// Role names and permissions are case-insensitive.
+type RoleTable struct {
+	Inherits    map[string][]string `json:"inherits"`    // role to roles it includes, i.e. admin: [moderator]
+	Permissions map[string][]string `json:"permissions"` // role to permissions granted to it directly
+}
+
+// LoadRoleTable reads RoleTable from json
+func LoadRoleTable(r io.Reader) (*RoleTable, error) {
+	res := RoleTable{}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, fmt.Errorf("can't decode role table: %w", err)
+	}
+	return &res, nil
+}
+
+// Expand returns passed roles with all roles inherited by them, lower-cased
+func (t *RoleTable) Expand(roles ...string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	queue := append([]string{}, roles...)
+	for len(queue) > 0 {
+		role := strings.ToLower(queue[0])
+		queue = queue[1:]
+		if role == "" || seen[role] {
+			continue
+		}
+		seen[role] = true
+		res = append(res, role)
+		if t != nil {
+			queue = append(queue, lookupFold(t.Inherits, role)...)
+		}
+	}
+	return res
+}
+
+// HasRole checks if the user has the role directly or inherited
+func (t *RoleTable) HasRole(u User, role string) bool {
+	for _, r := range t.Expand(u.GetRoles()...) {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserPermissions returns all permissions granted to the user's roles, direct and inherited
+func (t *RoleTable) UserPermissions(u User) []string {
+	res := []string{}
+	if t == nil {
+		return res
+	}
+	seen := map[string]bool{}
+	for _, role := range t.Expand(u.GetRoles()...) {
+		for _, p := range lookupFold(t.Permissions, role) {
+			if p = strings.ToLower(p); !seen[p] {
+				seen[p] = true
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+// HasPermission checks if the permission granted to any of user's roles
+func (t *RoleTable) HasPermission(u User, perm string) bool {
+	for _, p := range t.UserPermissions(u) {
+		if strings.EqualFold(p, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupFold returns values of the key matched case-insensitive
+func lookupFold(m map[string][]string, key string) (res []string) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			res = append(res, v...)
+		}
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package token
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleTable(t *testing.T) {
+	rt, err := LoadRoleTable(strings.NewReader(`{
+		"inherits": {"admin": ["moderator"], "Moderator": ["user"]},
+		"permissions": {"user": ["comments:read"], "moderator": ["comments:delete", "Comments:Read"], "admin": ["users:write"]}
+	}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"admin", "moderator", "user"}, rt.Expand("Admin"))
+	assert.Equal(t, []string{"guest"}, rt.Expand("guest"))
+
+	mod := User{Role: "moderator"}
+	assert.True(t, rt.HasRole(mod, "user"))
+	assert.True(t, rt.HasRole(mod, "MODERATOR"))
+	assert.True(t, rt.HasPermission(mod, "comments:delete"))
+	assert.True(t, mod.HasPermission(rt, "comments:read"))
+	assert.Equal(t, []string{"comments:delete", "comments:read"}, rt.UserPermissions(User{Role: "moderator", Roles: []string{"guest"}}))
+
+	guest := User{Roles: []string{"guest", "reader"}}
+	assert.False(t, rt.HasRole(guest, "user"))
+	assert.False(t, rt.HasPermission(guest, "comments:read"))
+
+	cycled := RoleTable{Inherits: map[string][]string{"a": {"b"}, "b": {"a", "c"}}}
+	assert.Equal(t, []string{"a", "b", "c"}, cycled.Expand("a"))
+
+	var empty *RoleTable
+	assert.True(t, empty.HasRole(mod, "moderator"), "nil table checks direct roles")
+	assert.False(t, empty.HasPermission(mod, "comments:read"))
+
+	_, err = LoadRoleTable(strings.NewReader(`{bad`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,183 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionRevokedError returned for tokens of revoked session
+var SessionRevokedError = fmt.Errorf(`session revoked`)
+
+// SessionUnknownError returned for tokens issued a while ago without recorded session, i.e. dropped by the store
+var SessionUnknownError = fmt.Errorf(`session unknown`)
+
+// sessionGrace is a time after the issue of token its session may be not seen by the store yet
+const sessionGrace = time.Minute
+
+// Session describes a single login. All tokens issued (and refreshed) for this login share the same id (jti),
+// used as a session id.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Provider  string    `json:"provider,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// SessionStore defines interface keeping user's sessions
+type SessionStore interface {
+	// Touch saves new session or updates LastSeen and non-empty IP and UserAgent of the existing one.
+	// Returns stored session, so the caller can check if it was revoked.
+	Touch(s Session) (Session, error)
+	Get(id string) (Session, error)
+	List(userID string) ([]Session, error) // active (not revoked) sessions, most recent first
+	Revoke(id string) error                // marks session revoked, should keep it till ttl to reject its tokens
+}
+
+// CheckSession checks session of the token issued (or the user authenticated) at given unix time.
+// Session should be recorded by the time, so unknown session rejected unless the token issued just now.
+// Tokens without issue time, i.e. made outside of Service.Set, allowed to start the session.
+func CheckSession(store SessionStore, id string, issued int64) error {
+	s, err := store.Get(id)
+	if err == nil {
+		if s.Revoked {
+			return SessionRevokedError
+		}
+		return nil
+	}
+	if issued == 0 || time.Since(time.Unix(issued, 0)) < sessionGrace {
+		return nil
+	}
+	return SessionUnknownError
+}
+
+// touchSession records session for claims issued by Set. Refreshed tokens keep time of the login,
+// so the session of refreshed token should be known already.
+func (j *Service) touchSession(claims Claims) error {
+	if err := CheckSession(j.SessionStore, claims.Id, claims.AuthTime); err != nil {
+		return err
+	}
+	now := time.Now()
+	s, err := j.SessionStore.Touch(Session{
+		ID:        claims.Id,
+		UserID:    claims.User.ID,
+		Provider:  sessionProvider(claims.User),
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+	if err != nil {
+		return fmt.Errorf("can't save session: %w", err)
+	}
+	if s.Revoked {
+		return SessionRevokedError
+	}
+	return nil
+}
+
+// sessionProvider extracts provider name from user id, all providers make ids as provider_hash
+func sessionProvider(u *User) string {
+	if i := strings.Index(u.ID, "_"); i > 0 {
+		return u.ID[:i]
+	}
+	return ""
+}
+
+// MemSessionStore implements SessionStore in memory, thread safe.
+// Sessions not seen for ttl removed on Touch calls, but not more often than once per minute.
+// Tokens of removed session rejected by CheckSession as unknown, so revoked session can't be recreated.
+type MemSessionStore struct {
+	lock        sync.Mutex
+	ttl         time.Duration
+	sessions    map[string]Session
+	lastCleanup time.Time
+}
+
+// NewMemSessionStore makes in-memory session store. ttl should be not less than cookie duration,
+// otherwise users not seen for ttl have to login again.
+func NewMemSessionStore(ttl time.Duration) *MemSessionStore {
+	return &MemSessionStore{ttl: ttl, sessions: map[string]Session{}, lastCleanup: time.Now()}
+}
+
+// Touch saves or updates session
+func (m *MemSessionStore) Touch(s Session) (Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if time.Since(m.lastCleanup) > time.Minute {
+		for id, sess := range m.sessions {
+			if time.Since(sess.LastSeen) > m.ttl {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastCleanup = time.Now()
+	}
+
+	if s.LastSeen.IsZero() {
+		s.LastSeen = time.Now()
+	}
+	existing, ok := m.sessions[s.ID]
+	if !ok {
+		if s.CreatedAt.IsZero() {
+			s.CreatedAt = s.LastSeen
+		}
+		m.sessions[s.ID] = s
+		return s, nil
+	}
+
+	existing.LastSeen = s.LastSeen
+	if s.IP != "" {
+		existing.IP = s.IP
+	}
+	if s.UserAgent != "" {
+		existing.UserAgent = s.UserAgent
+	}
+	if existing.Provider == "" {
+		existing.Provider = s.Provider
+	}
+	m.sessions[s.ID] = existing
+	return existing, nil
+}
+
+// Get returns session by id
+func (m *MemSessionStore) Get(id string) (Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return Session{}, fmt.Errorf("session %s not found", id)
+	}
+	return s, nil
+}
+
+// List returns active sessions of the user
+func (m *MemSessionStore) List(userID string) ([]Session, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && !s.Revoked {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].LastSeen.After(res[j].LastSeen) })
+	return res, nil
+}
+
+// Revoke marks session revoked, unknown session recorded as revoked too
+func (m *MemSessionStore) Revoke(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		s = Session{ID: id, CreatedAt: time.Now(), LastSeen: time.Now()}
+	}
+	s.Revoked = true
+	m.sessions[id] = s
+	return nil
+}
@@ -0,0 +1,103 @@
+package token
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession_MemStore(t *testing.T) {
+	m := NewMemSessionStore(time.Hour)
+
+	s, err := m.Touch(Session{ID: "s1", UserID: "u1", Provider: "github", CreatedAt: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.False(t, s.LastSeen.IsZero())
+	created := s.CreatedAt
+
+	time.Sleep(time.Millisecond)
+	s, err = m.Touch(Session{ID: "s1", UserID: "u1", IP: "127.0.0.1", UserAgent: "ua1"})
+	require.NoError(t, err)
+	assert.Equal(t, created, s.CreatedAt, "created time kept")
+	assert.True(t, s.LastSeen.After(created))
+	assert.Equal(t, "github", s.Provider)
+	assert.Equal(t, "127.0.0.1", s.IP)
+
+	s, err = m.Touch(Session{ID: "s1", UserID: "u1", UserAgent: "ua2"})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", s.IP, "empty ip ignored")
+	assert.Equal(t, "ua2", s.UserAgent)
+
+	_, err = m.Touch(Session{ID: "s2", UserID: "u1"})
+	require.NoError(t, err)
+	_, err = m.Touch(Session{ID: "s3", UserID: "u2"})
+	require.NoError(t, err)
+
+	list, err := m.List("u1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	assert.Equal(t, "s2", list[0].ID, "most recent first")
+
+	require.NoError(t, m.Revoke("s1"))
+	list, err = m.List("u1")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+
+	s, err = m.Touch(Session{ID: "s1", UserID: "u1"})
+	require.NoError(t, err)
+	assert.True(t, s.Revoked, "revoked session stays revoked")
+
+	require.NoError(t, m.Revoke("unknown"))
+	s, err = m.Get("unknown")
+	require.NoError(t, err)
+	assert.True(t, s.Revoked)
+
+	_, err = m.Get("bad")
+	assert.EqualError(t, err, "session bad not found")
+}
+
+func TestSession_ServiceSet(t *testing.T) {
+	store := NewMemSessionStore(time.Hour)
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), SessionStore: store})
+
+	claims := keysTestClaims()
+	claims.User.ID = "github_12345"
+	_, err := j.Set(httptest.NewRecorder(), claims)
+	require.NoError(t, err)
+
+	s, err := store.Get("random id")
+	require.NoError(t, err)
+	assert.Equal(t, "github_12345", s.UserID)
+	assert.Equal(t, "github", s.Provider)
+
+	require.NoError(t, j.Revoke(claims))
+	_, err = j.Set(httptest.NewRecorder(), claims)
+	assert.EqualError(t, err, "failed to record session: session revoked")
+}
+
+func TestCheckSession(t *testing.T) {
+	store := NewMemSessionStore(time.Hour)
+	_, err := store.Touch(Session{ID: "s1", UserID: "u1"})
+	require.NoError(t, err)
+	old := time.Now().Add(-time.Hour).Unix()
+
+	assert.NoError(t, CheckSession(store, "s1", old))
+	assert.NoError(t, CheckSession(store, "s2", time.Now().Unix()), "token issued just now")
+	assert.NoError(t, CheckSession(store, "s2", 0), "token without issue time")
+	assert.Equal(t, SessionUnknownError, CheckSession(store, "s2", old), "session dropped by the store")
+	require.NoError(t, store.Revoke("s1"))
+	assert.Equal(t, SessionRevokedError, CheckSession(store, "s1", old))
+
+	// refreshed token of dropped session can't start it again
+	j := NewService(Opts{SecretReader: SecretFunc(mockKeyStore), SessionStore: store})
+	claims := keysTestClaims()
+	claims.Id = "s3"
+	claims.SetAuth(AMRPassword)
+	_, err = j.Set(httptest.NewRecorder(), claims)
+	require.NoError(t, err, "login records session")
+	claims.Id, claims.AuthTime = "s4", old
+	_, err = j.Set(httptest.NewRecorder(), claims)
+	assert.EqualError(t, err, "failed to record session: session unknown")
+}
@@ -2,12 +2,14 @@ package token
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"hash/crc64"
 	"io"
 	"net/http"
 	"regexp"
+	"strings"
 )
 
 var reValidSha = regexp.MustCompile("^[a-fA-F0-9]{40}$")
@@ -31,6 +33,7 @@ type User struct {
 	Email      string                 `json:"email,omitempty"`
 	Attributes map[string]interface{} `json:"attrs,omitempty"`
 	Role       string                 `json:"role,omitempty"`
+	Roles      []string               `json:"roles,omitempty"` // additional roles, Role kept for older tokens
 }
 
 // SetBoolAttr sets boolean attribute
@@ -146,6 +149,28 @@ func SetUserInfo(r *http.Request, user User) *http.Request {
 	return r.WithContext(SetUserToCtx(r.Context(), user))
 }
 
+// GetClaims returns verified claims of the token from request context.
+// Populated by Auth, Trace, AdminOnly and RBAC middlewares, synthesized for basic auth.
+func GetClaims(r *http.Request) (Claims, error) {
+	return GetClaimsFromCtx(r.Context())
+}
+
+// SetClaims sets claims into request context
+func SetClaims(r *http.Request, claims Claims) *http.Request {
+	return r.WithContext(SetClaimsToCtx(r.Context(), claims))
+}
+
+// GetExtraInfo unmarshals application-defined claims of the token from request context to v.
+// Populated by Auth and Trace middlewares, returns NoExtraError if the token has none.
+func GetExtraInfo(r *http.Request, v interface{}) error {
+	return GetExtraFromCtx(r.Context(), v)
+}
+
+// SetExtraInfo sets application-defined claims into request context
+func SetExtraInfo(r *http.Request, extra json.RawMessage) *http.Request {
+	return r.WithContext(SetExtraToCtx(r.Context(), extra))
+}
+
 // SetRole sets user role for RBAC
 func (u *User) SetRole(role string) {
 	u.Role = role
@@ -155,3 +180,42 @@ func (u *User) SetRole(role string) {
 func (u *User) GetRole() string {
 	return u.Role
 }
+
+// AddRoles adds roles to the user, roles the user has already ignored
+func (u *User) AddRoles(roles ...string) {
+	for _, r := range roles {
+		if r != "" && !u.HasRole(r) {
+			u.Roles = append(u.Roles, r)
+		}
+	}
+}
+
+// GetRoles returns all roles of the user, Role first
+func (u *User) GetRoles() []string {
+	res := []string{}
+	if u.Role != "" {
+		res = append(res, u.Role)
+	}
+	for _, r := range u.Roles {
+		if !strings.EqualFold(r, u.Role) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// HasRole checks if the user has the role, case-insensitive. Roles inherited via RoleTable not checked,
+// use RoleTable.HasRole for it
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.GetRoles() {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission checks if any of user's roles, direct or inherited, grants the permission in RoleTable
+func (u *User) HasPermission(rt *RoleTable, perm string) bool {
+	return rt.HasPermission(*u, perm)
+}
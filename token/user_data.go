@@ -2,7 +2,9 @@ package token
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 )
 
 type Collections map[string]*Collection
@@ -21,6 +23,17 @@ type UserData struct {
 	Social      string                 `json:"social"`
 	Collections Collections            `json:"collections"`
 	Raw         map[string]interface{} `json:"raw"`
+	Upstream    *UpstreamToken         `json:"upstream,omitempty"` // oauth2 token issued by provider
+}
+
+// UpstreamToken is oauth2 token issued by provider, allows to call provider's api on behalf of the user
+type UpstreamToken struct {
+	Provider     string    `json:"provider"`
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"`
 }
 
 func (ud *UserData) SetRaw(key string, val interface{}) {
@@ -100,3 +113,29 @@ func GetUserFromCtx(ctx context.Context) (user User, err error) {
 func SetUserToCtx(ctx context.Context, user User) context.Context {
 	return context.WithValue(ctx, contextKey("user"), user)
 }
+
+func GetExtraFromCtx(ctx context.Context, v interface{}) error {
+	if ctx == nil {
+		return NoExtraError
+	}
+	extra, _ := ctx.Value(contextKey("extra")).(json.RawMessage)
+	return unmarshalExtra(extra, v)
+}
+
+func SetExtraToCtx(ctx context.Context, extra json.RawMessage) context.Context {
+	return context.WithValue(ctx, contextKey("extra"), extra)
+}
+
+func GetClaimsFromCtx(ctx context.Context) (Claims, error) {
+	if ctx == nil {
+		return Claims{}, fmt.Errorf("no claims")
+	}
+	if c, ok := ctx.Value(contextKey("claims")).(Claims); ok {
+		return c, nil
+	}
+	return Claims{}, fmt.Errorf("claims can't be parsed")
+}
+
+func SetClaimsToCtx(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, contextKey("claims"), claims)
+}
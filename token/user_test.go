@@ -98,6 +98,21 @@ func TestUser_PaidSubscriber(t *testing.T) {
 	assert.False(t, u.IsPaidSub())
 }
 
+func TestUser_Roles(t *testing.T) {
+	u := User{Name: "test", ID: "id"}
+	assert.Empty(t, u.GetRoles())
+	assert.False(t, u.HasRole(""))
+
+	u.SetRole("user")
+	u.AddRoles("Moderator", "USER", "", "moderator", "editor")
+	assert.Equal(t, []string{"user", "Moderator", "editor"}, u.GetRoles())
+	assert.True(t, u.HasRole("moderator"))
+	assert.False(t, u.HasRole("admin"))
+
+	u = User{Role: "user", Roles: []string{"user", "editor"}} // Role duplicated in Roles
+	assert.Equal(t, []string{"user", "editor"}, u.GetRoles())
+}
+
 func TestUser_GetUserInfo(t *testing.T) {
 	r, err := http.NewRequest("GET", "http://blah.com", http.NoBody)
 	assert.Nil(t, err)